@@ -0,0 +1,211 @@
+package chinadns
+
+import (
+	"encoding/json"
+	"github.com/0990/chinadns/pkg/cache"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminPathPrefix is the path prefix of admin api, which is served on the pprof listener.
+// The api has no authentication, mutating endpoints only accept POST.
+const AdminPathPrefix = "/admin/"
+
+// adminCacheEntry is a cache item shown by admin api, ttl is the remaining seconds, negative when it's stale.
+type adminCacheEntry struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Client   string   `json:"client,omitempty"` // the client group, empty for the global cache
+	Resolver string   `json:"resolver,omitempty"`
+	TTL      int64    `json:"ttl"`
+	Hits     uint32   `json:"hits"`
+	Answer   []string `json:"answer,omitempty"`
+}
+
+// AdminHandler returns the handler of admin api:
+//
+//	GET  /admin/cache/stats                 cache length and hit/miss counters, including caches of client groups
+//	GET  /admin/cache/entries?suffix=&limit= list cache items, optionally under a domain suffix
+//	POST /admin/cache/delete?name=          delete all types of a name
+//	POST /admin/cache/delete?suffix=        delete all names under a domain suffix
+//	POST /admin/cache/flush                 delete everything
+//	GET  /admin/rules/match?name=&type=&client= how a query is routed and the rule matching it, type is A by default
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(AdminPathPrefix+"cache/stats", s.handleCacheStats)
+	mux.HandleFunc(AdminPathPrefix+"cache/entries", s.handleCacheEntries)
+	mux.HandleFunc(AdminPathPrefix+"cache/delete", s.handleCacheDelete)
+	mux.HandleFunc(AdminPathPrefix+"cache/flush", s.handleCacheFlush)
+	mux.HandleFunc(AdminPathPrefix+"rules/match", s.handleRulesMatch)
+	return mux
+}
+
+func (s *Server) handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var stats cache.Stats
+	s.rangeCaches(func(group string, c cache.DNSCache) {
+		v := c.Stats()
+		stats.Len += v.Len
+		stats.Hits += v.Hits
+		stats.Misses += v.Misses
+	})
+	writeJSON(w, stats)
+}
+
+func (s *Server) handleCacheEntries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var limit int
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	suffix := r.URL.Query().Get("suffix")
+
+	now := time.Now()
+	entries := make([]adminCacheEntry, 0)
+	s.rangeCaches(func(group string, c cache.DNSCache) {
+		c.Range(func(q dns.Question, item cache.Item) bool {
+			if suffix != "" && !isSubDomain(q.Name, suffix) {
+				return true
+			}
+
+			ret := item.Value.(*LookupResult)
+			entry := adminCacheEntry{
+				Name:   q.Name,
+				Type:   dns.TypeToString[q.Qtype],
+				Client: group,
+				TTL:    int64(item.Remaining(now) / time.Second),
+				Hits:   item.Hits,
+			}
+			if ret.resolver != nil {
+				entry.Resolver = ret.resolver.String()
+			}
+			for _, rr := range ret.reply.Answer {
+				entry.Answer = append(entry.Answer, rr.String())
+			}
+			entries = append(entries, entry)
+			return true
+		})
+	})
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		if entries[i].Type != entries[j].Type {
+			return entries[i].Type < entries[j].Type
+		}
+		return entries[i].Client < entries[j].Client
+	})
+	// truncated after sorting, so the first ones by name are returned
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	writeJSON(w, entries)
+}
+
+func (s *Server) handleCacheDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, suffix := r.URL.Query().Get("name"), r.URL.Query().Get("suffix")
+	if name == "" && suffix == "" {
+		http.Error(w, "name or suffix is required", http.StatusBadRequest)
+		return
+	}
+
+	var deleted int
+	s.rangeCaches(func(group string, c cache.DNSCache) {
+		var keys []dns.Question
+		c.Range(func(q dns.Question, item cache.Item) bool {
+			if (name != "" && strings.EqualFold(q.Name, dns.Fqdn(name))) || (suffix != "" && isSubDomain(q.Name, suffix)) {
+				keys = append(keys, q)
+			}
+			return true
+		})
+
+		for _, q := range keys {
+			if c.Delete(q) {
+				deleted++
+			}
+		}
+	})
+	writeJSON(w, map[string]int{"deleted": deleted})
+}
+
+func (s *Server) handleCacheFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var n int
+	s.rangeCaches(func(group string, c cache.DNSCache) {
+		n += c.Len()
+		c.Flush()
+	})
+	writeJSON(w, map[string]int{"deleted": n})
+}
+
+func (s *Server) handleRulesMatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	qtype := dns.TypeA
+	if v := r.URL.Query().Get("type"); v != "" {
+		t, ok := dns.StringToType[strings.ToUpper(v)]
+		if !ok {
+			http.Error(w, "invalid type", http.StatusBadRequest)
+			return
+		}
+		qtype = t
+	}
+
+	var client net.IP
+	if v := r.URL.Query().Get("client"); v != "" {
+		if client = net.ParseIP(v); client == nil {
+			http.Error(w, "invalid client", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, s.ExplainDomain(name, qtype, client))
+}
+
+// isSubDomain reports whether name equals to domain or is under it, case insensitive.
+func isSubDomain(name, domain string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	domain = strings.ToLower(dns.Fqdn(domain))
+	return domain == "." || name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
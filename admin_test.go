@@ -0,0 +1,77 @@
+package chinadns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/0990/chinadns/pkg/cache"
+	"github.com/miekg/dns"
+)
+
+func TestServer_AdminHandler(t *testing.T) {
+	s := &Server{
+		serverOptions: &serverOptions{CacheNegativeTTL: 600},
+		cache:         cache.NewDNSCache(time.Hour),
+	}
+	for _, name := range []string{"example.com.", "www.example.com.", "a.b.example.com.", "notexample.com."} {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			reply := new(dns.Msg)
+			reply.SetQuestion(name, qtype)
+			soa, _ := dns.NewRR("example.com. 600 IN SOA ns.example.com. admin.example.com. 1 7200 3600 86400 600")
+			reply.Ns = []dns.RR{soa}
+			s.setCached(s.cache, reply.Question[0], &LookupResult{reply: reply})
+		}
+	}
+
+	h := s.AdminHandler()
+	do := func(method, target string, v any) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		if v != nil && w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code
+	}
+
+	var entries []adminCacheEntry
+	do(http.MethodGet, "/admin/cache/entries?suffix=EXAMPLE.com", &entries)
+	if len(entries) != 6 {
+		t.Errorf("entries %d,expect 6", len(entries))
+	}
+	// the first ones by name and type
+	do(http.MethodGet, "/admin/cache/entries?limit=3", &entries)
+	if len(entries) != 3 || entries[0].Name != "a.b.example.com." || entries[1].Type != "AAAA" || entries[2].Name != "example.com." {
+		t.Errorf("entries %+v,expect a.b.example.com. A,AAAA and example.com. A", entries)
+	}
+
+	var ret map[string]int
+	if code := do(http.MethodGet, "/admin/cache/delete?name=www.example.com", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("code %d,expect %d", code, http.StatusMethodNotAllowed)
+	}
+	do(http.MethodPost, "/admin/cache/delete?name=www.example.com", &ret)
+	if ret["deleted"] != 2 {
+		t.Errorf("deleted %d,expect 2", ret["deleted"])
+	}
+	do(http.MethodPost, "/admin/cache/delete?suffix=example.com", &ret)
+	if ret["deleted"] != 4 {
+		t.Errorf("deleted %d,expect 4", ret["deleted"])
+	}
+	if code := do(http.MethodGet, "/admin/cache/flush", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("code %d,expect %d", code, http.StatusMethodNotAllowed)
+	}
+	do(http.MethodPost, "/admin/cache/flush", &ret)
+	if ret["deleted"] != 2 {
+		t.Errorf("deleted %d,expect 2", ret["deleted"])
+	}
+
+	var stats cache.Stats
+	do(http.MethodGet, "/admin/cache/stats", &stats)
+	if stats.Len != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
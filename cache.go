@@ -1,20 +1,203 @@
 package chinadns
 
 import (
+	"github.com/0990/chinadns/pkg/cache"
 	"github.com/0990/chinadns/pkg/response"
 	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"net"
 	"time"
 )
 
-func (s *Server) setCached(question dns.Question, ret *LookupResult) {
+// staleTTL is the ttl of stale records in reply, https://www.rfc-editor.org/rfc/rfc8767#section-4
+const staleTTL = 30
+
+func (s *Server) setCached(c cache.DNSCache, question dns.Question, ret *LookupResult) {
 	if ret == nil {
 		return
 	}
 
+	var (
+		ttl uint32
+		ok  bool
+	)
 	mt, _ := response.Typify(ret.reply, time.Now().UTC())
 	switch mt {
 	case response.NoError, response.Delegation:
-		s.cache.Set(question, ret)
+		ttl, ok = minTTL(ret.reply)
+	case response.NameError, response.NoData:
+		if s.CacheNegativeTTL <= 0 {
+			return
+		}
+		ttl, ok = negativeTTL(ret.reply)
+		if ttl > uint32(s.CacheNegativeTTL) {
+			ttl = uint32(s.CacheNegativeTTL)
+		}
 	default:
 	}
+	if !ok {
+		return
+	}
+
+	// store a copy, the reply is filtered by resolver attrs after cached
+	c.Set(question, &LookupResult{
+		reply:    ret.reply.Copy(),
+		resolver: ret.resolver,
+	}, time.Duration(ttl)*time.Second)
+}
+
+// getCached returns the cached result of question, ttl of records are decremented by the time it has been cached.
+// client is used to prefetch the hot one.
+func (s *Server) getCached(c cache.DNSCache, question dns.Question, req *dns.Msg, client net.IP) (*LookupResult, bool) {
+	item, ok := c.Get(question)
+	if !ok {
+		return nil, false
+	}
+
+	r := item.Value.(*LookupResult)
+	reply := r.reply.Copy()
+	reply.Id = req.Id
+	decrementTTL(reply, item, time.Now())
+
+	if s.shouldPrefetch(item, time.Now()) {
+		s.refreshCache(reqDomain(req), req, client)
+	}
+
+	return &LookupResult{
+		reply:    reply,
+		resolver: r.resolver,
+	}, true
+}
+
+// getStale returns the cached result of question even if it's expired, ttl of records are set to staleTTL.
+func (s *Server) getStale(c cache.DNSCache, question dns.Question, req *dns.Msg) (*LookupResult, bool) {
+	item, ok := c.GetStale(question)
+	if !ok {
+		return nil, false
+	}
+
+	r := item.Value.(*LookupResult)
+	reply := r.reply.Copy()
+	reply.Id = req.Id
+	if item.IsExpired(time.Now()) {
+		setTTL(reply, staleTTL)
+	} else {
+		decrementTTL(reply, item, time.Now())
+	}
+
+	return &LookupResult{
+		reply:    reply,
+		resolver: r.resolver,
+	}, true
+}
+
+// refreshCache looks up req in background and updates the cache of client, the stale one is kept when failed.
+// Concurrent refreshes of the same question are merged.
+func (s *Server) refreshCache(reqDomain string, req *dns.Msg, client net.IP) {
+	req = req.Copy()
+	question := req.Question[0]
+
+	route := s.route(reqDomain, question.Qtype, client)
+	// replies of policies scoped by client are not cached
+	if route.policy.clientScoped() {
+		return
+	}
+	c := s.cacheOf(route.client)
+	key := questionString(&question)
+	if route.client != nil {
+		key = route.client.name + "/" + key
+	}
+
+	go func() {
+		_, _, _ = s.refreshGroup.Do(key, func() (any, error) {
+			logger := logrus.WithFields(logrus.Fields{
+				"q":       questionString(&question),
+				"id":      reqID(req),
+				"refresh": true,
+			})
+
+			ret := s.lookupUpstream(reqDomain, req, route, logger, time.Now())
+			if ret == nil {
+				logger.Warn("refresh cache failed")
+				return nil, nil
+			}
+			s.setCached(c, question, ret)
+			return nil, nil
+		})
+	}()
+}
+
+// shouldPrefetch reports whether a hot item is about to expire, it's hot when hit more than CachePrefetchHits times,
+// stale serves are not counted. Item is prefetched when less than 10% of its ttl remains, like unbound.
+func (s *Server) shouldPrefetch(item cache.Item, now time.Time) bool {
+	if s.CachePrefetchHits <= 0 || item.Hits <= uint32(s.CachePrefetchHits) {
+		return false
+	}
+	return item.Remaining(now) < item.TTL()/10
+}
+
+// minTTL returns the minimum ttl of all records in msg, OPT pseudo-record is skipped.
+func minTTL(msg *dns.Msg) (uint32, bool) {
+	var (
+		ttl uint32
+		ok  bool
+	)
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !ok || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				ok = true
+			}
+		}
+	}
+	return ttl, ok
+}
+
+// negativeTTL returns the ttl of NXDOMAIN/NODATA reply, which is the minimum of SOA ttl and SOA MINIMUM field,
+// https://www.rfc-editor.org/rfc/rfc2308#section-5
+func negativeTTL(msg *dns.Msg) (uint32, bool) {
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return min(soa.Hdr.Ttl, soa.Minttl), true
+		}
+	}
+	return 0, false
+}
+
+// decrementTTL decrements ttl of records by the elapsed time since cached,
+// ttl never exceeds the remaining cache time, which may differ from record ttl after clamped by min/max ttl.
+func decrementTTL(msg *dns.Msg, item cache.Item, now time.Time) {
+	elapsed := uint32(item.Elapsed(now) / time.Second)
+	remaining := uint32((item.Remaining(now) + time.Second - 1) / time.Second)
+	if remaining == 0 {
+		remaining = 1
+	}
+
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl <= elapsed || hdr.Ttl-elapsed > remaining {
+				hdr.Ttl = remaining
+			} else {
+				hdr.Ttl -= elapsed
+			}
+		}
+	}
+}
+
+func setTTL(msg *dns.Msg, ttl uint32) {
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			rr.Header().Ttl = ttl
+		}
+	}
 }
@@ -0,0 +1,178 @@
+package chinadns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/0990/chinadns/pkg/cache"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheFileEntry is a cache item saved in cache file, reply is in wire format.
+type cacheFileEntry struct {
+	Question dns.Question `json:"question"`
+	Reply    []byte       `json:"reply"`
+	Resolver string       `json:"resolver,omitempty"`
+	Group    string       `json:"group,omitempty"` // the client group, empty for the global cache
+	Created  time.Time    `json:"created"`
+	Expire   time.Time    `json:"expire"`
+}
+
+// SaveCache writes the cache and caches of client groups to CacheFile, it does nothing when CacheFile is not set.
+// The file is replaced atomically, so a crash while saving never breaks the old one.
+func (s *Server) SaveCache() error {
+	if s.CacheFile == "" {
+		return nil
+	}
+
+	start := time.Now()
+	var entries []cacheFileEntry
+	s.rangeCaches(func(group string, c cache.DNSCache) {
+		c.Range(func(q dns.Question, item cache.Item) bool {
+			r := item.Value.(*LookupResult)
+			reply, err := r.reply.Pack()
+			if err != nil {
+				logrus.WithError(err).WithField("q", questionString(&q)).Warn("pack cached reply")
+				return true
+			}
+
+			entry := cacheFileEntry{
+				Question: q,
+				Reply:    reply,
+				Group:    group,
+				Created:  item.Created,
+				Expire:   item.Expire,
+			}
+			if r.resolver != nil {
+				entry.Resolver = r.resolver.String()
+			}
+			entries = append(entries, entry)
+			return true
+		})
+	})
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.CacheFile), filepath.Base(s.CacheFile)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), s.CacheFile); err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"file":  s.CacheFile,
+		"count": len(entries),
+		"rtt":   timeSinceMS(start),
+	}).Info("cache saved")
+	return nil
+}
+
+// LoadCache restores the caches from CacheFile, items keep their original expire time.
+// Items whose resolver or client group is no longer configured are dropped, as the resolver decides how the reply is filtered.
+func (s *Server) LoadCache() (int, error) {
+	if s.CacheFile == "" {
+		return 0, nil
+	}
+
+	data, err := os.ReadFile(s.CacheFile)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	var entries []cacheFileEntry
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return 0, fmt.Errorf("cache file %s:%w", s.CacheFile, err)
+	}
+
+	rules := s.rules.Load()
+	resolvers := s.resolvers(rules)
+
+	var n int
+	for _, entry := range entries {
+		c := s.cache
+		if entry.Group != "" {
+			g := rules.clientGroupByName(entry.Group)
+			if g == nil {
+				continue
+			}
+			c = s.cacheOf(g)
+		}
+
+		var resolver *Resolver
+		if entry.Resolver != "" {
+			r, ok := resolvers[entry.Resolver]
+			if !ok {
+				continue
+			}
+			resolver = r
+		}
+
+		reply := new(dns.Msg)
+		if err := reply.Unpack(entry.Reply); err != nil {
+			continue
+		}
+
+		c.SetItem(entry.Question, cache.Item{
+			Value:   &LookupResult{reply: reply, resolver: resolver},
+			Created: entry.Created,
+			Expire:  entry.Expire,
+		})
+		n++
+	}
+	return n, nil
+}
+
+// resolvers returns the configured resolvers of server and rules, key is the resolver string.
+// Upstreams in domain rules are not included, which are parsed when used.
+func (s *Server) resolvers(rules *ruleSet) map[string]*Resolver {
+	lists := []resolverList{s.DNSChinaServers, s.DNSAbroadServers, s.DNSAdBlockServers, rules.lanServers}
+	for _, list := range rules.groups {
+		lists = append(lists, list)
+	}
+	for _, list := range rules.domain2DNS {
+		lists = append(lists, list)
+	}
+
+	resolvers := make(map[string]*Resolver)
+	for _, list := range lists {
+		for _, r := range list {
+			resolvers[r.String()] = r
+		}
+	}
+	return resolvers
+}
+
+// snapshotCache saves the cache periodically, so that not everything is lost after a crash.
+func (s *Server) snapshotCache() error {
+	ticker := time.NewTicker(time.Duration(s.CacheSnapshotSec) * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.SaveCache(); err != nil {
+			logrus.WithError(err).Error("snapshot cache")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,479 @@
+package chinadns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/0990/chinadns/pkg/cache"
+	"github.com/miekg/dns"
+)
+
+func Test_decrementTTL(t *testing.T) {
+	newMsg := func() *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("www.example.com.", dns.TypeA)
+		cname, _ := dns.NewRR("www.example.com. 3600 IN CNAME example.com.")
+		a, _ := dns.NewRR("example.com. 300 IN A 1.2.3.4")
+		msg.Answer = []dns.RR{cname, a}
+		msg.SetEdns0(4096, false)
+		return msg
+	}
+
+	if ttl, ok := minTTL(newMsg()); !ok || ttl != 300 {
+		t.Fatalf("minTTL %d,expect 300", ttl)
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		ttl     time.Duration
+		want    []uint32
+	}{
+		{"fresh", 0, 300 * time.Second, []uint32{300, 300}},
+		{"elapsed", 100 * time.Second, 300 * time.Second, []uint32{200, 200}},
+		{"max ttl clamped", 10 * time.Second, 60 * time.Second, []uint32{50, 50}},
+		{"min ttl clamped", 400 * time.Second, 600 * time.Second, []uint32{200, 200}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := newMsg()
+			created := now.Add(-tt.elapsed)
+			decrementTTL(msg, cache.Item{Created: created, Expire: created.Add(tt.ttl)}, now)
+			for i, rr := range msg.Answer {
+				if rr.Header().Ttl != tt.want[i] {
+					t.Errorf("answer %d ttl %d,expect %d", i, rr.Header().Ttl, tt.want[i])
+				}
+			}
+			if opt := msg.IsEdns0(); opt == nil || opt.UDPSize() != 4096 {
+				t.Errorf("opt record changed")
+			}
+		})
+	}
+}
+
+func TestServer_setCachedNegative(t *testing.T) {
+	newReply := func(rcode int, soaTTL, minTTL uint32) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("nx.example.com.", dns.TypeA)
+		reply := new(dns.Msg)
+		reply.SetRcode(req, rcode)
+		soa, _ := dns.NewRR(fmt.Sprintf("example.com. %d IN SOA ns.example.com. admin.example.com. 1 7200 3600 86400 %d", soaTTL, minTTL))
+		reply.Ns = []dns.RR{soa}
+		return reply
+	}
+
+	tests := []struct {
+		name        string
+		reply       *dns.Msg
+		negativeTTL int64
+		want        time.Duration
+	}{
+		{"nxdomain soa minimum", newReply(dns.RcodeNameError, 3600, 60), 300, 60 * time.Second},
+		{"nodata soa ttl", newReply(dns.RcodeSuccess, 30, 600), 300, 30 * time.Second},
+		{"capped", newReply(dns.RcodeNameError, 3600, 900), 300, 300 * time.Second},
+		{"disabled", newReply(dns.RcodeNameError, 3600, 60), -1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				serverOptions: &serverOptions{CacheNegativeTTL: tt.negativeTTL},
+				cache:         cache.NewDNSCache(time.Hour),
+			}
+			q := tt.reply.Question[0]
+			s.setCached(s.cache, q, &LookupResult{reply: tt.reply})
+
+			item, ok := s.cache.Get(q)
+			if tt.want == 0 {
+				if ok {
+					t.Fatalf("negative reply cached")
+				}
+				return
+			}
+			if !ok || item.TTL() != tt.want {
+				t.Fatalf("cached ttl %v,expect %v", item.TTL(), tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_SaveLoadCache(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cache.json")
+	removed, _ := ParseResolver("udp@1.1.1.1:53", false)
+
+	opts := func(withGroups bool) []ServerOption {
+		opts := []ServerOption{WithCacheFile(file, 0)}
+		if withGroups {
+			opts = append(opts,
+				WithUpstreamGroups(map[string][]string{"corp": {"udp@10.0.0.53:53"}}),
+				WithClients(map[string]ClientConfig{"kids": {IP: []string{"192.168.1.100"}}}),
+			)
+		}
+		return append(opts, WithDomain2DNS(map[string][]string{"lan": {"udp@192.168.1.1:53"}}))
+	}
+	newReply := func(name string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		a, _ := dns.NewRR(name + " 600 IN A 1.2.3.4")
+		msg.Answer = []dns.RR{a}
+		return msg
+	}
+
+	u := newFakeUpstream("1.2.3.4")
+	s := newTestServer(t, u, opts(true)...)
+	rules := s.rules.Load()
+	kids := s.cacheOf(rules.clientGroupByName("kids"))
+	for _, v := range []struct {
+		c        cache.DNSCache
+		name     string
+		resolver *Resolver
+	}{
+		{s.cache, "china.example.com.", s.DNSChinaServers[0]},
+		{s.cache, "abroad.example.com.", s.DNSAbroadServers[0]},
+		{s.cache, "corp.example.com.", rules.groups["corp"][0]},
+		{s.cache, "nas.lan.", rules.domain2DNS["lan"][0]},
+		{s.cache, "removed.example.com.", removed},
+		{kids, "kids.example.com.", s.DNSChinaServers[0]},
+	} {
+		reply := newReply(v.name)
+		s.setCached(v.c, reply.Question[0], &LookupResult{reply: reply, resolver: v.resolver})
+	}
+	if err := s.SaveCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	// loaded when created
+	s = newTestServer(t, u, opts(true)...)
+	if n := s.cache.Len(); n != 4 {
+		t.Fatalf("loaded %d,expect 4", n)
+	}
+	if n := s.cacheOf(s.rules.Load().clientGroupByName("kids")).Len(); n != 1 {
+		t.Fatalf("loaded %d of client group,expect 1", n)
+	}
+
+	for name, resolver := range map[string]string{
+		"abroad.example.com.": "udp@8.8.8.8:53",
+		"corp.example.com.":   "udp@10.0.0.53:53",
+		"nas.lan.":            "udp@192.168.1.1:53",
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		ret, ok := s.getCached(s.cache, req.Question[0], req, nil)
+		if !ok {
+			t.Fatalf("%s not loaded", name)
+		}
+		if ret.resolver.String() != resolver {
+			t.Errorf("%s resolver %v,expect %s", name, ret.resolver, resolver)
+		}
+		if ttl := ret.reply.Answer[0].Header().Ttl; ttl == 0 || ttl > 600 {
+			t.Errorf("%s ttl %d", name, ttl)
+		}
+	}
+
+	// the removed upstream group and client group are dropped
+	s = newTestServer(t, u, opts(false)...)
+	if n := s.cache.Len(); n != 3 {
+		t.Fatalf("loaded %d,expect 3", n)
+	}
+	var groups int
+	s.clientCaches.Range(func(_, _ any) bool {
+		groups++
+		return true
+	})
+	if groups != 0 {
+		t.Errorf("caches of client groups %d,expect 0", groups)
+	}
+}
+
+// recordWriter is a dns.ResponseWriter of a udp client at 127.0.0.1, which records the replies
+type recordWriter struct {
+	sync.Mutex
+	replies []*dns.Msg
+}
+
+func (w *recordWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *recordWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10053}
+}
+
+func (w *recordWriter) WriteMsg(m *dns.Msg) error {
+	w.Lock()
+	defer w.Unlock()
+	w.replies = append(w.replies, m)
+	return nil
+}
+
+func (w *recordWriter) Write(buf []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil {
+		return 0, err
+	}
+	return len(buf), w.WriteMsg(m)
+}
+
+func (w *recordWriter) Close() error        { return nil }
+func (w *recordWriter) TsigStatus() error   { return nil }
+func (w *recordWriter) TsigTimersOnly(bool) {}
+func (w *recordWriter) Hijack()             {}
+
+// fakeUpstream is a LookupFunc answering A queries with its ip and ttl 600, it fails when down,
+// and blocks until release is closed if it's not nil.
+type fakeUpstream struct {
+	ip      atomic.Value
+	down    atomic.Bool
+	queries atomic.Int32
+	release chan struct{}
+}
+
+func newFakeUpstream(ip string) *fakeUpstream {
+	u := &fakeUpstream{}
+	u.ip.Store(ip)
+	return u
+}
+
+func (u *fakeUpstream) lookup(ctx context.Context, req *dns.Msg, server *Resolver) (*dns.Msg, string, error) {
+	u.queries.Add(1)
+	if u.release != nil {
+		<-u.release
+	}
+	if u.down.Load() {
+		return nil, "", errors.New("upstream down")
+	}
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	a, _ := dns.NewRR(req.Question[0].Name + " 600 IN A " + u.ip.Load().(string))
+	reply.Answer = []dns.RR{a}
+	return reply, "", nil
+}
+
+// newTestServer returns a server whose upstreams are u, baidu.com is routed to dns-china by the test rules
+func newTestServer(t *testing.T, u *fakeUpstream, opts ...ServerOption) *Server {
+	opts = append(testRuleOptions(t, t.TempDir(),
+		WithDNS([]string{"udp@114.114.114.114:53"}, []string{"udp@8.8.8.8:53"}, nil),
+		WithCacheExpireSec(3600),
+	), opts...)
+	s, err := NewServer(&Client{}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.lookup, s.lookupProxyPriority = u.lookup, u.lookup
+	return s
+}
+
+// serve sends a query of name to s and returns the reply
+func serve(t *testing.T, s *Server, name string) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+
+	w := &recordWriter{}
+	s.Serve(w, req)
+	if len(w.replies) != 1 {
+		t.Fatalf("%s replies %d,expect 1", name, len(w.replies))
+	}
+	return w.replies[0]
+}
+
+// checkAnswer checks the reply has a single A record of ip, and its ttl if ttl>0
+func checkAnswer(t *testing.T, reply *dns.Msg, ip string, ttl uint32) {
+	t.Helper()
+	if len(reply.Answer) != 1 {
+		t.Fatalf("answers %v,expect %s", reply.Answer, ip)
+	}
+	a := reply.Answer[0].(*dns.A)
+	if a.A.String() != ip {
+		t.Errorf("answer %s,expect %s", a.A, ip)
+	}
+	if ttl > 0 && a.Hdr.Ttl != ttl {
+		t.Errorf("ttl %d,expect %d", a.Hdr.Ttl, ttl)
+	}
+}
+
+// setExpired caches an A record of ip for name, which has expired for a while
+func setExpired(s *Server, name, ip string, expired time.Duration) {
+	reply := new(dns.Msg)
+	reply.SetQuestion(name, dns.TypeA)
+	a, _ := dns.NewRR(name + " 600 IN A " + ip)
+	reply.Answer = []dns.RR{a}
+
+	now := time.Now()
+	s.cache.SetItem(reply.Question[0], cache.Item{
+		Value:   &LookupResult{reply: reply},
+		Created: now.Add(-expired - 600*time.Second),
+		Expire:  now.Add(-expired),
+	})
+}
+
+// waitFor waits until cond is true, and fails after a second
+func waitFor(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond * 5) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timeout:%s", msg)
+}
+
+func TestServer_ServeStale(t *testing.T) {
+	u := newFakeUpstream("2.2.2.2")
+	s := newTestServer(t, u, WithCacheServeStale(true, 3600, false))
+	const name = "www.baidu.com."
+
+	// the stale one is not used when upstream works
+	setExpired(s, name, "1.1.1.1", time.Minute)
+	checkAnswer(t, serve(t, s, name), "2.2.2.2", 600)
+
+	// the stale one is used when all upstreams fail
+	u.down.Store(true)
+	setExpired(s, name, "1.1.1.1", time.Minute)
+	checkAnswer(t, serve(t, s, name), "1.1.1.1", staleTTL)
+	if n := u.queries.Load(); n != 2 {
+		t.Errorf("upstream queries %d,expect 2", n)
+	}
+
+	// the one expired longer than CacheStaleMaxAge is dropped
+	s = newTestServer(t, u, WithCacheServeStale(true, 1, false))
+	setExpired(s, name, "1.1.1.1", time.Millisecond*900)
+	time.Sleep(time.Millisecond * 200)
+	if reply := serve(t, s, name); len(reply.Answer) != 0 {
+		t.Errorf("outdated stale answer %v", reply.Answer)
+	}
+}
+
+func TestServer_ServeStaleOptimistic(t *testing.T) {
+	u := newFakeUpstream("2.2.2.2")
+	s := newTestServer(t, u, WithCacheServeStale(true, 3600, true))
+	const name = "www.baidu.com."
+
+	// the stale one is returned at once, and refreshed in background
+	setExpired(s, name, "1.1.1.1", time.Minute)
+	checkAnswer(t, serve(t, s, name), "1.1.1.1", staleTTL)
+	waitFor(t, func() bool {
+		item, ok := s.cache.Get(dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		return ok && item.Value.(*LookupResult).reply.Answer[0].(*dns.A).A.String() == "2.2.2.2"
+	}, "cache not refreshed")
+	checkAnswer(t, serve(t, s, name), "2.2.2.2", 0)
+
+	// the stale one is kept when refresh failed
+	u.down.Store(true)
+	setExpired(s, name, "1.1.1.1", time.Minute)
+	checkAnswer(t, serve(t, s, name), "1.1.1.1", staleTTL)
+	waitFor(t, func() bool { return u.queries.Load() == 2 }, "cache not refreshed")
+	checkAnswer(t, serve(t, s, name), "1.1.1.1", staleTTL)
+}
+
+func TestServer_refreshCacheMerged(t *testing.T) {
+	u := newFakeUpstream("2.2.2.2")
+	u.release = make(chan struct{})
+	s := newTestServer(t, u, WithCacheServeStale(true, 3600, true))
+	const name = "www.baidu.com."
+
+	setExpired(s, name, "1.1.1.1", time.Minute)
+	var wg sync.WaitGroup
+	w := &recordWriter{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion(name, dns.TypeA)
+			s.Serve(w, req)
+		}()
+	}
+	wg.Wait()
+	if len(w.replies) != 10 {
+		t.Fatalf("replies %d,expect 10", len(w.replies))
+	}
+	for _, reply := range w.replies {
+		checkAnswer(t, reply, "1.1.1.1", staleTTL)
+	}
+
+	// let the background refreshes start and wait for the first one
+	time.Sleep(time.Millisecond * 50)
+	close(u.release)
+	waitFor(t, func() bool {
+		_, ok := s.cache.Get(dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		return ok
+	}, "cache not refreshed")
+	if n := u.queries.Load(); n != 1 {
+		t.Errorf("upstream queries %d,expect 1", n)
+	}
+}
+
+func TestServer_shouldPrefetch(t *testing.T) {
+	now := time.Now()
+	newItem := func(hits uint32, remaining time.Duration) cache.Item {
+		return cache.Item{Created: now.Add(remaining - 100*time.Second), Expire: now.Add(remaining), Hits: hits}
+	}
+
+	tests := []struct {
+		name     string
+		prefetch int
+		item     cache.Item
+		want     bool
+	}{
+		{"below hits", 3, newItem(2, 5*time.Second), false},
+		{"at hits", 3, newItem(3, 5*time.Second), false},
+		{"above hits", 3, newItem(4, 5*time.Second), true},
+		{"more than 10% ttl remains", 3, newItem(4, 11*time.Second), false},
+		{"10% ttl remains", 3, newItem(4, 10*time.Second), false},
+		{"disabled", 0, newItem(100, 5*time.Second), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{serverOptions: &serverOptions{CachePrefetchHits: tt.prefetch}}
+			if got := s.shouldPrefetch(tt.item, now); got != tt.want {
+				t.Errorf("shouldPrefetch %v,expect %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_ServePrefetch(t *testing.T) {
+	u := newFakeUpstream("2.2.2.2")
+	s := newTestServer(t, u, WithCachePrefetch(2))
+	const name = "www.baidu.com."
+
+	// 5% of the ttl remains
+	reply := new(dns.Msg)
+	reply.SetQuestion(name, dns.TypeA)
+	a, _ := dns.NewRR(name + " 100 IN A 1.1.1.1")
+	reply.Answer = []dns.RR{a}
+	now := time.Now()
+	s.cache.SetItem(reply.Question[0], cache.Item{
+		Value:   &LookupResult{reply: reply},
+		Created: now.Add(-95 * time.Second),
+		Expire:  now.Add(5 * time.Second),
+	})
+
+	// not hot until hit more than 2 times
+	for i := 0; i < 2; i++ {
+		checkAnswer(t, serve(t, s, name), "1.1.1.1", 0)
+	}
+	time.Sleep(time.Millisecond * 20)
+	if n := u.queries.Load(); n != 0 {
+		t.Fatalf("upstream queries %d,expect 0", n)
+	}
+
+	// the hot one is answered from cache and refreshed by lookupUpstream in background
+	checkAnswer(t, serve(t, s, name), "1.1.1.1", 0)
+	waitFor(t, func() bool {
+		item, ok := s.cache.Get(reply.Question[0])
+		return ok && item.Value.(*LookupResult).reply.Answer[0].(*dns.A).A.String() == "2.2.2.2"
+	}, "cache not prefetched")
+	if n := u.queries.Load(); n != 1 {
+		t.Errorf("upstream queries %d,expect 1", n)
+	}
+	checkAnswer(t, serve(t, s, name), "2.2.2.2", 0)
+}
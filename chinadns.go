@@ -2,24 +2,86 @@ package chinadns
 
 type Config struct {
 	Listen         string `json:"listen"`
+	DoHListen      string `json:"doh-listen"` //doh监听地址,为空不启用
+	DoHPath        string `json:"doh-path"`   //doh路径,默认/dns-query
+	DoTListen      string `json:"dot-listen"` //dot监听地址,为空不启用
+	DoQListen      string `json:"doq-listen"` //doq监听地址,为空不启用
+	TLSCert        string `json:"tls-cert"`   //证书文件,doh为空时使用http,文件更新后自动重新加载
+	TLSKey         string `json:"tls-key"`    //证书私钥文件
 	UDPMaxBytes    int    `json:"udp-max-bytes"`
 	Timeout        int    `json:"timeout"`          //查询超时时间
-	CacheExpireSec int    `json:"cache_expire_sec"` //缓存超时时间
+	CacheExpireSec int    `json:"cache_expire_sec"` //缓存最长时间,即ttl上限,<=0不启用缓存
+	CacheMinTTL    int    `json:"cache_min_ttl"`    //缓存最短时间,即ttl下限
 
-	Domain2IP map[string]string `json:"domain2ip"` //自定义dns,优先于domain2attr
+	CacheServeStale  bool `json:"cache_serve_stale"`   //上游dns都失败时使用过期缓存
+	CacheStaleMaxAge int  `json:"cache_stale_max_age"` //过期缓存最长可用时间,默认86400秒
+	CacheOptimistic  bool `json:"cache_optimistic"`    //乐观缓存,直接返回过期缓存并在后台刷新
+	CachePrefetch    int  `json:"cache_prefetch"`      //缓存命中超过此次数时,在过期前预取,<=0不启用
+
+	CacheNegativeTTL int `json:"cache_negative_ttl"` //不存在域名(NXDOMAIN/NODATA)缓存最长时间,按SOA最小ttl缓存,默认300秒,<0不缓存
+
+	CacheMaxEntries int   `json:"cache_max_entries"` //缓存最大条数,超出时淘汰最久未使用的,<=0时为100000
+	CacheMaxBytes   int64 `json:"cache_max_bytes"`   //缓存最大内存(字节),<=0不限制
+
+	CacheFile        string `json:"cache_file"`         //缓存文件,退出时保存缓存,启动时加载,为空不启用
+	CacheSnapshotSec int    `json:"cache_snapshot_sec"` //定时保存缓存的间隔(秒),默认600,<0不定时保存
+
+	Domain2IP  map[string]string   `json:"domain2ip"`  //自定义dns,优先于domain2attr
+	Hosts      []string            `json:"hosts"`      //hosts格式的文件,如/etc/hosts,与domain2ip合并,同一域名以domain2ip为准,文件变化时自动重新加载
+	Domain2DNS map[string][]string `json:"domain2dns"` //域名后缀:上游dns列表,格式同dns-china,该域名及子域名使用指定的上游dns,优先于policies
 
 	DNSChina       []string `json:"dns-china"`        //国内dns
 	DNSAbroad      []string `json:"dns-abroad"`       //海外dns,可信dns
 	DNSAbroadAttr  string   `json:"dns-abroad-attr"`  //海外dns特性 noipv4 noipv6 nocname
 	DNSAbroadProxy string   `json:"dns-abroad-proxy"` //海外dns代理，格式socks5://x.x.x.x:port,暂只支持socks5
+	DoHMethod      string   `json:"doh-method"`       //doh请求方式 GET POST,默认GET
+
+	DNSLan []string `json:"dns-lan"` //内网dns,私有地址的PTR查询使用此dns,为空时返回NXDOMAIN
 
 	DNSAdBlock      []string `json:"dns-adblock"`       //广告拦截dns
 	DNSAdBlockReply []string `json:"dns-adblock-reply"` //广告拦截dns返回值，用于判定是广告域名
 
-	ChnIP     []string `json:"chn_ip"` //国内ip列表
-	ChnDomain []string `json:"chn_domain"`
-	GfwDomain []string `json:"gfw_domain"`
+	ChnIP        []string `json:"chn_ip"`         //国内ip列表
+	ChnIPCountry []string `json:"chn_ip_country"` //chn_ip为mmdb文件时,作为国内ip的国家代码,默认["CN"]
+	ChnDomain    []string `json:"chn_domain"`
+	GfwDomain    []string `json:"gfw_domain"`
+
+	GeoSite string `json:"geosite"` //chn_domain,gfw_domain中geosite:cn等引用的geosite.dat文件,默认geosite.dat
+	GeoIP   string `json:"geoip"`   //chn_ip中geoip:cn等引用的geoip.dat文件,默认geoip.dat
+
+	UpstreamGroups map[string][]string `json:"upstream_groups"` //自定义上游dns组,组名:dns列表,格式同dns-china
+	Policies       []PolicyConfig      `json:"policies"`        //分流策略,按顺序匹配,都不匹配时按chn_domain,gfw_domain,chn_ip分流
+
+	Clients map[string]ClientConfig `json:"clients"` //客户端分组,组名:该组设置
+
+	DomainUpstream bool `json:"domain_upstream"` //chn_domain,gfw_domain为dnsmasq格式时,使用server=/域名/上游dns中的上游dns解析该域名
+
+	RulesWatch      bool   `json:"rules_watch"`       //配置文件及chn_domain,gfw_domain,chn_ip文件变化时自动重新加载规则
+	RulesDir        string `json:"rules_dir"`         //chn_domain,gfw_domain,chn_ip为http(s)地址时,下载文件的保存目录,默认rules
+	RulesRefreshSec int    `json:"rules_refresh_sec"` //远程规则更新间隔(秒),默认86400,<0不更新
+	RulesProxy      bool   `json:"rules_proxy"`       //通过dns-abroad-proxy下载远程规则
+
+	RulesRefresh map[string]int `json:"rules_refresh"` //各远程规则的更新间隔(秒),地址:间隔,未配置的使用rules_refresh_sec
+
+	LogLevel    string `json:"log_level"`
+	PProfPort   int    `json:"pprof_port"`   //pprof及管理接口端口,<=0不启用
+	PProfListen string `json:"pprof_listen"` //pprof及管理接口监听地址,默认127.0.0.1
+}
+
+// PolicyConfig is a policy in config, queries matching all the conditions are resolved by the upstream group,
+// empty condition matches all.
+type PolicyConfig struct {
+	Domain   []string `json:"domain"`   //域名列表,格式同chn_domain
+	QType    []string `json:"qtype"`    //查询类型,如A,AAAA,HTTPS
+	Client   []string `json:"client"`   //客户端ip或网段,如192.168.1.0/24
+	Upstream string   `json:"upstream"` //上游组名,china,abroad,auto或upstream_groups中的组名
+}
 
-	LogLevel  string `json:"log_level"`
-	PProfPort int    `json:"pprof_port"`
+// ClientConfig is the settings of a client group, which override the global ones
+type ClientConfig struct {
+	IP            []string       `json:"ip"`              //客户端ip或网段,ip属于多个组时使用网段最小的
+	Policies      []PolicyConfig `json:"policies"`        //该组的分流策略,先于全局policies匹配
+	AdBlock       *bool          `json:"adblock"`         //是否同时查询dns-adblock过滤广告,为空时同全局
+	DNSAbroadAttr string         `json:"dns-abroad-attr"` //海外dns特性,为空时同全局
+	Blocklist     []string       `json:"blocklist"`       //屏蔽的域名列表,格式同chn_domain,返回NXDOMAIN
 }
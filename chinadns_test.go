@@ -4,9 +4,32 @@ import (
 	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
+// writeTestFile writes content to the file name in dir and returns its path
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testRuleOptions returns the options of minimal rules in dir, baidu.com in chn_domain, google.com in gfw_domain
+// and 1.0.1.0/24 in chn_ip, followed by opts.
+func testRuleOptions(t *testing.T, dir string, opts ...ServerOption) []ServerOption {
+	t.Helper()
+	return append([]ServerOption{
+		WithChnDomain([]string{writeTestFile(t, dir, "chn.txt", "baidu.com\n")}),
+		WithGfwDomain([]string{writeTestFile(t, dir, "gfw.txt", "google.com\n")}),
+		WithCHNFile([]string{writeTestFile(t, dir, "chnroute.txt", "1.0.1.0/24\n")}),
+	}, opts...)
+}
+
 func Test_CreateConfig(t *testing.T) {
 
 	cfg := Config{
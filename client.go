@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"github.com/0990/chinadns/pkg/doh"
+	"github.com/0990/chinadns/pkg/doq"
+	"github.com/0990/chinadns/pkg/dot"
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 	"strings"
@@ -14,13 +16,19 @@ import (
 type Client struct {
 	*clientOptions
 
-	UDPCli *dns.Client
-	TCPCli *dns.Client
-	DoHCli *doh.Client
+	UDPCli  *dns.Client
+	TCPCli  *dns.Client
+	DoHCli  *doh.Client
+	DoH3Cli *doh.Client
+	DoTCli  *dot.Client
+	DoQCli  *doq.Client
 
-	DoHCliProxy *doh.Client
-	proxyProto  string
-	proxyAddr   string
+	DoHCliProxy  *doh.Client
+	DoH3CliProxy *doh.Client
+	DoTCliProxy  *dot.Client
+	DoQCliProxy  *doq.Client
+	proxyProto   string
+	proxyAddr    string
 }
 
 func NewClient(opts ...ClientOption) (*Client, error) {
@@ -57,12 +65,45 @@ func NewClient(opts ...ClientOption) (*Client, error) {
 		DoHCli: doh.NewClient(
 			doh.WithTimeout(o.Timeout),
 			doh.WithSkipQueryMySelf(true),
+			doh.WithMethod(o.DoHMethod),
+		),
+		DoH3Cli: doh.NewClient(
+			doh.WithTimeout(o.Timeout),
+			doh.WithSkipQueryMySelf(true),
+			doh.WithMethod(o.DoHMethod),
+			doh.WithHTTP3(true),
+		),
+		DoTCli: dot.NewClient(
+			dot.WithTimeout(o.Timeout),
+			dot.WithSkipQueryMySelf(true),
+		),
+		DoQCli: doq.NewClient(
+			doq.WithTimeout(o.Timeout),
+			doq.WithSkipQueryMySelf(true),
 		),
 		DoHCliProxy: doh.NewClient(
 			doh.WithTimeout(o.Timeout),
 			doh.WithSkipQueryMySelf(true),
+			doh.WithMethod(o.DoHMethod),
+			doh.WithSocks5Proxy(proxyAddr),
+		),
+		DoH3CliProxy: doh.NewClient(
+			doh.WithTimeout(o.Timeout),
+			doh.WithSkipQueryMySelf(true),
+			doh.WithMethod(o.DoHMethod),
+			doh.WithHTTP3(true),
 			doh.WithSocks5Proxy(proxyAddr),
 		),
+		DoTCliProxy: dot.NewClient(
+			dot.WithTimeout(o.Timeout),
+			dot.WithSkipQueryMySelf(true),
+			dot.WithSocks5Proxy(proxyAddr),
+		),
+		DoQCliProxy: doq.NewClient(
+			doq.WithTimeout(o.Timeout),
+			doq.WithSkipQueryMySelf(true),
+			doq.WithSocks5Proxy(proxyAddr),
+		),
 		proxyProto: proxyProto,
 		proxyAddr:  proxyAddr,
 	}, nil
@@ -107,6 +148,24 @@ func (c *Client) lookup(ctx context.Context, req *dns.Msg, server *Resolver) (re
 				return
 			}
 			logger.WithError(err).Error("Fail to send DoH query.")
+		case "doh3":
+			reply, _, err = c.DoH3Cli.Exchange(ctx, req, server.GetAddr())
+			if err == nil {
+				return
+			}
+			logger.WithError(err).Error("Fail to send DoH3 query.")
+		case "dot":
+			reply, _, err = c.DoTCli.Exchange(ctx, req, server.GetAddr(), server.ServerName)
+			if err == nil {
+				return
+			}
+			logger.WithError(err).Error("Fail to send DoT query.")
+		case "doq":
+			reply, _, err = c.DoQCli.Exchange(ctx, req, server.GetAddr(), server.ServerName)
+			if err == nil {
+				return
+			}
+			logger.WithError(err).Error("Fail to send DoQ query.")
 		default:
 			logger.Errorf("Protocol %s is unsupported in normal method.", protocol)
 			return
@@ -147,6 +206,24 @@ func (c *Client) lookupByProxy(ctx context.Context, req *dns.Msg, server *Resolv
 				return
 			}
 			logger.WithError(err).Error("Fail to send DoH query.")
+		case "doh3":
+			reply, _, err = c.DoH3CliProxy.Exchange(ctx, req, server.GetAddr())
+			if err == nil {
+				return
+			}
+			logger.WithError(err).Error("Fail to send DoH3 query.")
+		case "dot":
+			reply, _, err = c.DoTCliProxy.Exchange(ctx, req, server.GetAddr(), server.ServerName)
+			if err == nil {
+				return
+			}
+			logger.WithError(err).Error("Fail to send DoT query.")
+		case "doq":
+			reply, _, err = c.DoQCliProxy.Exchange(ctx, req, server.GetAddr(), server.ServerName)
+			if err == nil {
+				return
+			}
+			logger.WithError(err).Error("Fail to send DoQ query.")
 		default:
 			logger.Errorf("Protocol %s is unsupported in normal method.", protocol)
 			return
@@ -160,6 +237,7 @@ type clientOptions struct {
 	UDPMaxSize     int           // Max message size for UDP queries
 	TCPOnly        bool          // Use TCP only
 	DNSAbroadProxy string        //socks5://x.x.x.x:port
+	DoHMethod      string        //GET or POST
 }
 
 type ClientOption func(*clientOptions)
@@ -187,3 +265,9 @@ func WithDNSAboardProxy(proxy string) ClientOption {
 		o.DNSAbroadProxy = proxy
 	}
 }
+
+func WithDoHMethod(method string) ClientOption {
+	return func(o *clientOptions) {
+		o.DoHMethod = method
+	}
+}
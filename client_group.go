@@ -0,0 +1,149 @@
+package chinadns
+
+import (
+	"fmt"
+	"github.com/0990/chinadns/pkg/cache"
+	"github.com/0990/chinadns/pkg/matcher"
+	"net"
+	"sort"
+)
+
+// clientGroup is the settings of clients in the networks, which override the global ones
+type clientGroup struct {
+	name       string
+	networks   []*net.IPNet
+	policies   []*policy       // checked before the global policies
+	adBlock    *bool           // nil means the global setting
+	abroadAttr []DomainAttr    // nil means the global setting
+	blocklist  matcher.Matcher // domains answered NXDOMAIN, nil if none
+}
+
+func WithClients(clients map[string]ClientConfig) ServerOption {
+	return func(o *serverOptions) error {
+		// in a stable order, for the groups with the same network
+		names := make([]string, 0, len(clients))
+		for name := range clients {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			g, err := newClientGroup(o, name, clients[name])
+			if err != nil {
+				return fmt.Errorf("clients[%s]:%w", name, err)
+			}
+			o.rules.clients = append(o.rules.clients, g)
+		}
+		return nil
+	}
+}
+
+func newClientGroup(o *serverOptions, name string, c ClientConfig) (*clientGroup, error) {
+	if len(c.IP) == 0 {
+		return nil, fmt.Errorf("no ip")
+	}
+
+	g := &clientGroup{name: name, adBlock: c.AdBlock}
+	for _, v := range c.IP {
+		network, err := parseNetwork(v)
+		if err != nil {
+			return nil, err
+		}
+		g.networks = append(g.networks, network)
+	}
+
+	for i, v := range c.Policies {
+		p, err := newPolicy(o, fmt.Sprintf("clients[%s].policies[%d]", name, i), v)
+		if err != nil {
+			return nil, fmt.Errorf("policies[%d]:%w", i, err)
+		}
+		g.policies = append(g.policies, p)
+	}
+
+	if c.DNSAbroadAttr != "" {
+		g.abroadAttr = parseDomainAttrs(c.DNSAbroadAttr)
+	}
+
+	if len(c.Blocklist) > 0 {
+		m, err := newDomainMatcher(o, c.Blocklist)
+		if err != nil {
+			return nil, err
+		}
+		g.blocklist = m
+	}
+	return g, nil
+}
+
+// clientGroup returns the group whose network contains client most specifically, nil if none.
+func (r *ruleSet) clientGroup(client net.IP) *clientGroup {
+	if client == nil {
+		return nil
+	}
+
+	var (
+		found *clientGroup
+		ones  = -1
+	)
+	for _, g := range r.clients {
+		for _, network := range g.networks {
+			if n, _ := network.Mask.Size(); n > ones && network.Contains(client) {
+				found, ones = g, n
+			}
+		}
+	}
+	return found
+}
+
+// clientGroupByName returns the group named name, nil if none
+func (r *ruleSet) clientGroupByName(name string) *clientGroup {
+	for _, g := range r.clients {
+		if g.name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// blocked returns the rule of blocklist matching domain
+func (g *clientGroup) blocked(domain string) (matcher.Rule, bool) {
+	if g == nil || g.blocklist == nil {
+		return matcher.Rule{}, false
+	}
+	return matcher.Explain(g.blocklist, domain)
+}
+
+// cacheOf returns the cache of client group, each group has its own cache as the replies may differ.
+func (s *Server) cacheOf(g *clientGroup) cache.DNSCache {
+	if g == nil {
+		return s.cache
+	}
+	if c, ok := s.clientCaches.Load(g.name); ok {
+		return c.(cache.DNSCache)
+	}
+	c, _ := s.clientCaches.LoadOrStore(g.name, newCache(s.serverOptions))
+	return c.(cache.DNSCache)
+}
+
+// flushCaches empties the global cache and removes caches of client groups, it returns the count of items removed.
+func (s *Server) flushCaches() int {
+	var n int
+	s.rangeCaches(func(group string, c cache.DNSCache) {
+		n += c.Len()
+		if group == "" {
+			c.Flush()
+		} else {
+			// the group may be removed by the new rules, it's created again when used
+			s.clientCaches.Delete(group)
+		}
+	})
+	return n
+}
+
+// rangeCaches calls f for the global cache and caches of client groups, group is empty for the global one.
+func (s *Server) rangeCaches(f func(group string, c cache.DNSCache)) {
+	f("", s.cache)
+	s.clientCaches.Range(func(k, v any) bool {
+		f(k.(string), v.(cache.DNSCache))
+		return true
+	})
+}
@@ -7,18 +7,38 @@ import (
 	"github.com/0990/chinadns"
 	"github.com/0990/chinadns/internal/version"
 	"github.com/0990/chinadns/pkg/logconfig"
+	"github.com/0990/chinadns/pkg/subscribe"
+	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 var confFile = flag.String("c", "chinadns.json", "config file")
 var workingDir = flag.String("w", "", "working dir")
 var versionFlag = flag.Bool("version", false, "Show version and then quit")
+var matchFlag = flag.String("match", "", "Show how the domain is routed by rules and then quit")
+var matchClientFlag = flag.String("match-client", "", "Client ip of -match")
+
+const (
+	defaultRulesDir        = "rules"
+	defaultRulesRefreshSec = 86400
+	defaultGeoSite         = "geosite.dat"
+	defaultGeoIP           = "geoip.dat"
+	defaultPProfListen     = "127.0.0.1"
+)
+
+// subscriptions keeps the local copies of remote rule files
+var subscriptions *subscribe.Manager
 
 func main() {
 	flag.Parse()
@@ -34,31 +54,20 @@ func main() {
 		cfgFile = *workingDir + "/" + cfgFile
 	}
 
-	file, err := os.Open(cfgFile)
+	cfg, err := loadConfig(cfgFile)
 	if err != nil {
 		logrus.Fatalln(err)
 	}
 
-	var cfg chinadns.Config
-	err = json.NewDecoder(file).Decode(&cfg)
-	if err != nil {
-		logrus.Fatalln(err)
+	if *matchFlag != "" {
+		if err := printMatch(cfg, *matchFlag, *matchClientFlag); err != nil {
+			logrus.Fatalln(err)
+		}
+		os.Exit(0)
 	}
 
 	var logName = "logs/chinadns"
-
 	if *workingDir != "" {
-		for i, v := range cfg.ChnDomain {
-			cfg.ChnDomain[i] = filepath.Join(*workingDir, v)
-		}
-
-		for i, v := range cfg.GfwDomain {
-			cfg.GfwDomain[i] = filepath.Join(*workingDir, v)
-		}
-
-		for i, v := range cfg.ChnIP {
-			cfg.ChnIP[i] = filepath.Join(*workingDir, v)
-		}
 		logName = filepath.Join(*workingDir, logName)
 	}
 
@@ -69,7 +78,7 @@ func main() {
 
 	go func() {
 		if cfg.PProfPort > 0 {
-			err := http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", cfg.PProfPort), nil)
+			err := http.ListenAndServe(net.JoinHostPort(cfg.PProfListen, strconv.Itoa(cfg.PProfPort)), nil)
 			if err != nil {
 				logrus.Fatalln(err)
 			}
@@ -78,7 +87,7 @@ func main() {
 
 	logconfig.InitLogrus(logName, 10, level)
 
-	logrus.Info("config", cfg)
+	logrus.Info("config", *cfg)
 	logrus.WithFields(logrus.Fields{
 		"version": version.String(),
 		"build":   version.BuildString(),
@@ -88,20 +97,35 @@ func main() {
 		chinadns.WithUDPMaxBytes(cfg.UDPMaxBytes),
 		chinadns.WithTimeout(time.Duration(cfg.Timeout) * time.Second),
 		chinadns.WithDNSAboardProxy(cfg.DNSAbroadProxy),
+		chinadns.WithDoHMethod(cfg.DoHMethod),
 	}
 
 	sopts := []chinadns.ServerOption{
 		chinadns.WithListenAddr(cfg.Listen),
+		chinadns.WithDoHListen(cfg.DoHListen, cfg.DoHPath),
+		chinadns.WithDoTListen(cfg.DoTListen),
+		chinadns.WithDoQListen(cfg.DoQListen),
+		chinadns.WithTLSCert(cfg.TLSCert, cfg.TLSKey),
 		chinadns.WithCacheExpireSec(cfg.CacheExpireSec),
+		chinadns.WithCacheMinTTL(cfg.CacheMinTTL),
+		chinadns.WithCacheServeStale(cfg.CacheServeStale, cfg.CacheStaleMaxAge, cfg.CacheOptimistic),
+		chinadns.WithCachePrefetch(cfg.CachePrefetch),
+		chinadns.WithCacheNegativeTTL(cfg.CacheNegativeTTL),
+		chinadns.WithCacheMaxSize(cfg.CacheMaxEntries, cfg.CacheMaxBytes),
+		chinadns.WithCacheFile(cfg.CacheFile, cfg.CacheSnapshotSec),
 		chinadns.WithDNS(cfg.DNSChina, cfg.DNSAbroad, cfg.DNSAdBlock),
-		chinadns.WithDomain2IP(cfg.Domain2IP),
 		chinadns.WithDNSAboardAttr(cfg.DNSAbroadAttr),
 		chinadns.WithAdBlockReply(cfg.DNSAdBlockReply),
-		chinadns.WithCHNFile(cfg.ChnIP),
-		chinadns.WithChnDomain(cfg.ChnDomain),
-		chinadns.WithGfwDomain(cfg.GfwDomain),
+		chinadns.WithDomainUpstream(cfg.DomainUpstream),
 	}
 
+	subscriptions = newSubscriptions(cfg)
+	ropts, err := ruleOptions(cfg)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+	sopts = append(sopts, ropts...)
+
 	client, err := chinadns.NewClient(copts...)
 	if err != nil {
 		panic(err)
@@ -111,6 +135,9 @@ func main() {
 		panic(err)
 	}
 
+	// admin api shares the pprof listener
+	http.Handle(chinadns.AdminPathPrefix, server.AdminHandler())
+
 	go func() {
 		err := server.Run()
 		if err != nil {
@@ -118,8 +145,261 @@ func main() {
 		}
 	}()
 
+	// the watcher is always created, files may be added by reloading
+	watcher, err := newRuleWatcher()
+	if err != nil {
+		logrus.WithError(err).Error("watch rules")
+	}
+
+	// reloads are triggered by SIGHUP, the watcher and subscriptions concurrently,
+	// they run one by one so that rules of an earlier build never replace newer ones
+	var reloadMu sync.Mutex
+	apply := func() error {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+
+		cfg, err := reloadRules(server, cfgFile)
+		if err != nil {
+			return err
+		}
+		if watcher != nil {
+			watcher.set(watchedFiles(cfgFile, cfg))
+		}
+		return nil
+	}
+	reload := func() {
+		if err := apply(); err != nil {
+			logrus.WithError(err).Error("reload rules failed,keep the old ones")
+		}
+	}
+
+	if watcher != nil {
+		watcher.set(watchedFiles(cfgFile, cfg))
+		go watcher.run(reload)
+	}
+
+	// always run, as subscriptions may be added by reloading
+	go subscriptions.Run(apply)
+
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	s := <-c
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	var s os.Signal
+	for s = range c {
+		if s != syscall.SIGHUP {
+			break
+		}
+		logrus.Info("reload rules,Got signal:", s)
+		reload()
+	}
 	fmt.Println("quit,Got signal:", s)
+
+	if err := server.SaveCache(); err != nil {
+		logrus.WithError(err).Error("save cache")
+	}
+}
+
+func loadConfig(cfgFile string) (*chinadns.Config, error) {
+	file, err := os.Open(cfgFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var cfg chinadns.Config
+	err = json.NewDecoder(file).Decode(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.RulesDir == "" {
+		cfg.RulesDir = defaultRulesDir
+	}
+	if cfg.GeoSite == "" {
+		cfg.GeoSite = defaultGeoSite
+	}
+	if cfg.GeoIP == "" {
+		cfg.GeoIP = defaultGeoIP
+	}
+	if cfg.RulesRefreshSec == 0 {
+		cfg.RulesRefreshSec = defaultRulesRefreshSec
+	}
+	if cfg.PProfListen == "" {
+		cfg.PProfListen = defaultPProfListen
+	}
+
+	if *workingDir != "" {
+		for _, paths := range ruleLists(&cfg) {
+			for i, v := range paths {
+				if !isRuleRef(v) {
+					paths[i] = filepath.Join(*workingDir, v)
+				}
+			}
+		}
+
+		cfg.RulesDir = filepath.Join(*workingDir, cfg.RulesDir)
+		cfg.GeoSite = filepath.Join(*workingDir, cfg.GeoSite)
+		cfg.GeoIP = filepath.Join(*workingDir, cfg.GeoIP)
+
+		if cfg.TLSCert != "" {
+			cfg.TLSCert = filepath.Join(*workingDir, cfg.TLSCert)
+			cfg.TLSKey = filepath.Join(*workingDir, cfg.TLSKey)
+		}
+		if cfg.CacheFile != "" {
+			cfg.CacheFile = filepath.Join(*workingDir, cfg.CacheFile)
+		}
+	}
+	return &cfg, nil
+}
+
+// ruleOptions returns the options which can be reloaded by Server.ReloadRules,
+// remote rule files are replaced by their local copies.
+func ruleOptions(cfg *chinadns.Config) ([]chinadns.ServerOption, error) {
+	var rules [3][]string
+	for i, paths := range [][]string{cfg.ChnIP, cfg.ChnDomain, cfg.GfwDomain} {
+		local, err := localRules(cfg, paths)
+		if err != nil {
+			return nil, err
+		}
+		rules[i] = local
+	}
+
+	policies, err := localPolicies(cfg, cfg.Policies)
+	if err != nil {
+		return nil, err
+	}
+
+	clients := make(map[string]chinadns.ClientConfig, len(cfg.Clients))
+	for name, v := range cfg.Clients {
+		if v.Policies, err = localPolicies(cfg, v.Policies); err != nil {
+			return nil, err
+		}
+		if v.Blocklist, err = localRules(cfg, v.Blocklist); err != nil {
+			return nil, err
+		}
+		clients[name] = v
+	}
+
+	return []chinadns.ServerOption{
+		chinadns.WithGeoData(cfg.GeoSite, cfg.GeoIP),
+		chinadns.WithChinaCountries(cfg.ChnIPCountry),
+		chinadns.WithDomain2IP(cfg.Domain2IP),
+		chinadns.WithHosts(cfg.Hosts),
+		chinadns.WithDomain2DNS(cfg.Domain2DNS),
+		chinadns.WithDNSLan(cfg.DNSLan),
+		chinadns.WithCHNFile(rules[0]),
+		chinadns.WithChnDomain(rules[1]),
+		chinadns.WithGfwDomain(rules[2]),
+		chinadns.WithUpstreamGroups(cfg.UpstreamGroups),
+		chinadns.WithPolicies(policies),
+		chinadns.WithClients(clients),
+	}, nil
+}
+
+// ruleLists returns all the lists of rule paths in config
+func ruleLists(cfg *chinadns.Config) [][]string {
+	lists := [][]string{cfg.ChnDomain, cfg.GfwDomain, cfg.ChnIP, cfg.Hosts}
+	for _, v := range cfg.Policies {
+		lists = append(lists, v.Domain)
+	}
+	for _, c := range cfg.Clients {
+		lists = append(lists, c.Blocklist)
+		for _, v := range c.Policies {
+			lists = append(lists, v.Domain)
+		}
+	}
+	return lists
+}
+
+func localPolicies(cfg *chinadns.Config, policies []chinadns.PolicyConfig) ([]chinadns.PolicyConfig, error) {
+	local := make([]chinadns.PolicyConfig, len(policies))
+	for i, v := range policies {
+		domain, err := localRules(cfg, v.Domain)
+		if err != nil {
+			return nil, err
+		}
+		v.Domain = domain
+		local[i] = v
+	}
+	return local, nil
+}
+
+// localRules replaces remote rule files by their local copies
+func localRules(cfg *chinadns.Config, paths []string) ([]string, error) {
+	var local []string
+	for _, v := range paths {
+		if subscribe.IsURL(v) {
+			file, err := subscriptions.Add(v, refreshInterval(cfg, v))
+			if err != nil {
+				return nil, err
+			}
+			v = file
+		}
+		local = append(local, v)
+	}
+	return local, nil
+}
+
+// refreshInterval returns the refresh interval of the remote rule file, rules_refresh overrides rules_refresh_sec
+func refreshInterval(cfg *chinadns.Config, url string) time.Duration {
+	sec := cfg.RulesRefreshSec
+	if v, ok := cfg.RulesRefresh[url]; ok {
+		sec = v
+	}
+	return time.Duration(sec) * time.Second
+}
+
+func newSubscriptions(cfg *chinadns.Config) *subscribe.Manager {
+	var opts []subscribe.Option
+	if cfg.RulesProxy && cfg.DNSAbroadProxy != "" {
+		opts = append(opts, subscribe.WithSocks5Proxy(strings.TrimPrefix(cfg.DNSAbroadProxy, "socks5://")))
+	}
+	return subscribe.New(cfg.RulesDir, opts...)
+}
+
+// printMatch prints how domain is routed by the rules in config
+func printMatch(cfg *chinadns.Config, domain, client string) error {
+	var clientIP net.IP
+	if client != "" {
+		if clientIP = net.ParseIP(client); clientIP == nil {
+			return fmt.Errorf("invalid client ip %s", client)
+		}
+	}
+
+	subscriptions = newSubscriptions(cfg)
+	opts, err := ruleOptions(cfg)
+	if err != nil {
+		return err
+	}
+	qtype := dns.TypeA
+	if strings.HasSuffix(strings.TrimSuffix(domain, "."), ".arpa") {
+		qtype = dns.TypePTR
+	}
+	route, err := chinadns.ExplainDomain(domain, qtype, clientIP, opts...)
+	if err != nil {
+		return err
+	}
+
+	if route.Client != "" {
+		fmt.Printf("client group %s\n", route.Client)
+	}
+	switch {
+	case route.Route == chinadns.RouteBlocked:
+		fmt.Printf("%s: %s, rule %s\n", route.Domain, route.Route, route.Rule)
+	case route.IP != "":
+		fmt.Printf("%s: %s, %s\n", route.Domain, route.Route, route.IP)
+	case route.Zone != "":
+		fmt.Printf("%s: %s, zone %s\n", route.Domain, route.Route, route.Zone)
+	case route.Rule != nil:
+		fmt.Printf("%s: %s, policy %s, rule %s\n", route.Domain, route.Route, route.Policy, route.Rule)
+	case route.Policy == "":
+		fmt.Printf("%s: %s\n", route.Domain, route.Route)
+	default:
+		fmt.Printf("%s: %s, policy %s\n", route.Domain, route.Route, route.Policy)
+	}
+	return nil
+}
+
+// isRuleRef reports whether the rule path is not a local file path, but a url or a list in geo data file
+func isRuleRef(path string) bool {
+	return subscribe.IsURL(path) || strings.HasPrefix(path, "geosite:") || strings.HasPrefix(path, "geoip:")
 }
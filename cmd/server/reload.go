@@ -0,0 +1,135 @@
+package main
+
+import (
+	"github.com/0990/chinadns"
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// files are usually written in several steps, reload once after they are quiet for a while
+const watchDelay = time.Second
+
+// reloadRules reads the config file again and reloads the rule files in it, it returns the new config.
+func reloadRules(server *chinadns.Server, cfgFile string) (*chinadns.Config, error) {
+	cfg, err := loadConfig(cfgFile)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := ruleOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, server.ReloadRules(opts...)
+}
+
+// watchedFiles returns the files watched for reloading, which are the config file and all rule files if rules_watch is enabled,
+// and the hosts files always.
+func watchedFiles(cfgFile string, cfg *chinadns.Config) []string {
+	if !cfg.RulesWatch {
+		return cfg.Hosts
+	}
+	paths := []string{cfgFile, cfg.GeoSite, cfg.GeoIP}
+	for _, v := range ruleLists(cfg) {
+		paths = append(paths, v...)
+	}
+	return paths
+}
+
+// ruleWatcher calls reload when any of the watched files change.
+// Directories are watched instead of files, as files are often replaced by rename.
+type ruleWatcher struct {
+	watcher *fsnotify.Watcher
+
+	sync.Mutex
+	files map[string]bool
+	dirs  map[string]bool
+}
+
+// newRuleWatcher creates the watcher without any file, call set to watch files and run to handle the changes
+func newRuleWatcher() (*ruleWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ruleWatcher{
+		watcher: watcher,
+		files:   make(map[string]bool),
+		dirs:    make(map[string]bool),
+	}, nil
+}
+
+// set replaces the watched files, it's called again after reloading as the files in config may change
+func (w *ruleWatcher) set(paths []string) {
+	files := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, v := range paths {
+		// remote files are reloaded by subscriptions, and geo data files are watched themselves
+		if isRuleRef(v) {
+			continue
+		}
+		path, err := filepath.Abs(v)
+		if err != nil {
+			logrus.WithError(err).WithField("file", v).Error("watch rules")
+			continue
+		}
+		files[path] = true
+		dirs[filepath.Dir(path)] = true
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	for dir := range w.dirs {
+		if !dirs[dir] {
+			_ = w.watcher.Remove(dir)
+		}
+	}
+	for dir := range dirs {
+		if w.dirs[dir] {
+			continue
+		}
+		if err := w.watcher.Add(dir); err != nil {
+			logrus.WithError(err).WithField("dir", dir).Error("watch rules")
+			delete(dirs, dir)
+		}
+	}
+	w.files, w.dirs = files, dirs
+}
+
+func (w *ruleWatcher) watched(file string) bool {
+	w.Lock()
+	defer w.Unlock()
+	return w.files[filepath.Clean(file)]
+}
+
+// run calls reload when any of the watched files change, until the watcher is closed
+func (w *ruleWatcher) run(reload func()) {
+	defer w.watcher.Close()
+
+	timer := time.NewTimer(watchDelay)
+	timer.Stop()
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if !w.watched(event.Name) || event.Has(fsnotify.Chmod) {
+				continue
+			}
+			logrus.WithField("file", event.Name).Debug("rule file changed")
+			timer.Reset(watchDelay)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.WithError(err).Error("watch rules")
+		case <-timer.C:
+			reload()
+		}
+	}
+}
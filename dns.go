@@ -20,6 +20,11 @@ type LookupResult struct {
 	resolver *Resolver
 }
 
+// Size returns the wire size of reply, which is used to limit the cache memory.
+func (r *LookupResult) Size() int {
+	return r.reply.Len()
+}
+
 func reqID(req *dns.Msg) string {
 	return strconv.FormatInt(int64(req.Id), 16)
 }
@@ -40,9 +45,20 @@ func (s *Server) Serve(w dns.ResponseWriter, req *dns.Msg) {
 
 	reqDomain := reqDomain(req)
 
+	client := clientIP(w)
+	route := s.route(reqDomain, question.Qtype, client)
+	// replies of policies for some clients are not shared by others, and each client group has its own cache
+	useCache := !route.policy.clientScoped()
+	c := s.cacheOf(route.client)
+
+	blockRule, blocked := route.client.blocked(reqDomain)
+	if blocked {
+		useCache = false
+	}
+
 	defer func() {
-		if !hitCache {
-			s.setCached(question, lookupRet)
+		if !hitCache && useCache {
+			s.setCached(c, question, lookupRet)
 		}
 
 		if lookupRet == nil {
@@ -54,7 +70,7 @@ func (s *Server) Serve(w dns.ResponseWriter, req *dns.Msg) {
 		}
 
 		var filter bool
-		if attrs := s.getResolverAttr(lookupRet.resolver); len(attrs) > 0 {
+		if attrs := s.getResolverAttr(lookupRet.resolver, route.client); len(attrs) > 0 {
 			filter = filterLookupRetByAttrs(lookupRet, attrs)
 		}
 
@@ -74,6 +90,18 @@ func (s *Server) Serve(w dns.ResponseWriter, req *dns.Msg) {
 		}).Debug("DNS reply")
 	}()
 
+	//客户端分组屏蔽的域名
+	if blocked {
+		logger.WithFields(logrus.Fields{
+			"client": route.client.name,
+			"rule":   blockRule,
+		}).Debug("blocked")
+		reply := new(dns.Msg)
+		reply.SetRcode(req, dns.RcodeNameError)
+		lookupRet = &LookupResult{reply: reply}
+		return
+	}
+
 	//自定义域名中查找
 	if reply, ok := s.lookUpInCustom(reqDomain, req); ok {
 		lookupRet = &LookupResult{
@@ -83,28 +111,45 @@ func (s *Server) Serve(w dns.ResponseWriter, req *dns.Msg) {
 		return
 	}
 
-	if v, ok := s.cache.Get(question); ok {
-		hitCache = true
-
-		r := v.(*LookupResult)
-		reply := r.reply.Copy()
-		reply.Id = req.Id
-		lookupRet = &LookupResult{
-			reply:    reply,
-			resolver: r.resolver,
+	if useCache {
+		if ret, ok := s.getCached(c, question, req, client); ok {
+			hitCache = true
+			lookupRet = ret
+			return
 		}
-		return
 	}
 
-	//ip反向查找域名类型查询，暂不支持
-	if req.Question[0].Qtype == dns.TypePTR {
-		return
+	var staleRet *LookupResult
+	if s.CacheServeStale && useCache {
+		if ret, ok := s.getStale(c, question, req); ok {
+			// return the expired one at once and refresh it in background
+			if s.CacheOptimistic {
+				hitCache = true
+				lookupRet = ret
+				s.refreshCache(reqDomain, req, client)
+				return
+			}
+			staleRet = ret
+		}
 	}
+
 	//s.normalizeRequest(req)
 
-	lookupRetChnGfw := make(chan *LookupResult)
+	lookupRet = s.lookupUpstream(reqDomain, req, route, logger, start)
+
+	//所有上游都失败时，使用过期的缓存
+	if lookupRet == nil && staleRet != nil {
+		logger.Warn("lookup failed,serve stale cache")
+		hitCache = true
+		lookupRet = staleRet
+	}
+}
+
+// lookupUpstream queries adblock dns and china/abroad dns at the same time, returns nil when all failed.
+func (s *Server) lookupUpstream(reqDomain string, req *dns.Msg, route policyRoute, logger *logrus.Entry, start time.Time) *LookupResult {
+	lookupRetChnGfw := make(chan *LookupResult, 1)
 	go func() {
-		ret, err := s.lookupChnGfw(reqDomain, req, logger, start)
+		ret, err := s.lookupChnGfw(reqDomain, req, route, logger, start)
 		if err != nil {
 			lookupRetChnGfw <- nil
 			logger.WithError(err).Error("query error")
@@ -113,28 +158,43 @@ func (s *Server) Serve(w dns.ResponseWriter, req *dns.Msg) {
 		lookupRetChnGfw <- ret
 	}()
 
-	if len(s.DNSAdBlockServers) > 0 {
+	if len(s.DNSAdBlockServers) > 0 && route.adBlock() {
 		adBlockResult, err := s.lookupAdBlock(req)
 		if err == nil && adBlockResult != nil && s.DNSAdBlockJudge.IsAdBlockReply(adBlockResult.reply) {
-			lookupRet = adBlockResult
-			return
+			return adBlockResult
 		} else if err != nil {
 			logger.WithError(err).Error("query error")
 		}
 	}
 
-	lookupRet = <-lookupRetChnGfw
+	return <-lookupRetChnGfw
 }
 
-func (s *Server) lookupChnGfw(reqDomain string, req *dns.Msg, logger *logrus.Entry, start time.Time) (*LookupResult, error) {
-	//国内域名直接走国内dns
-	if s.chnDomainMatcher.IsMatch(reqDomain) {
-		return lookupInServers(req, s.DNSChinaServers, time.Second*2, s.lookup)
+func (s *Server) lookupChnGfw(reqDomain string, req *dns.Msg, route policyRoute, logger *logrus.Entry, start time.Time) (*LookupResult, error) {
+	//domain2dns中的域名使用指定的上游dns
+	if zone, servers, ok := route.rules.stubZone(reqDomain); ok {
+		logger.WithField("zone", zone).Debug("match domain2dns")
+		return lookupInServers(req, servers, time.Second*2, s.lookup)
 	}
 
-	//gfw block的域名直接使用国外dns
-	if s.gfwDomainMatcher.IsMatch(reqDomain) {
-		return lookupInServers(req, s.DNSAbroadServers, time.Second*2, s.lookupProxyPriority)
+	//ip反向查找域名按ip分流,配置的策略匹配时按策略
+	if req.Question[0].Qtype == dns.TypePTR && route.policy.builtin {
+		if ip := ptrIP(reqDomain); ip != nil {
+			return s.lookupPTR(ip, req, route.rules, logger)
+		}
+	}
+
+	p := route.policy
+	entry := logger.WithField("policy", p)
+	if p.domain != nil {
+		entry = entry.WithField("rule", route.rule)
+	}
+	entry.Debug("match policy")
+
+	//chn_domain直接走国内dns,gfw_domain直接使用国外dns,或策略指定的上游组
+	if p.group != GroupAuto {
+		servers, lookup := s.groupServers(route.rules, p.group)
+		return lookupInServers(req, s.domainServers(route.rules, p.domain, reqDomain, servers), time.Second*2, lookup)
 	}
 
 	lookupRetAbroad := make(chan *LookupResult, 1)
@@ -185,7 +245,12 @@ func (s *Server) lookupAdBlock(req *dns.Msg) (*LookupResult, error) {
 
 // 查找自定义域名
 func (s *Server) lookUpInCustom(domain string, req *dns.Msg) (*dns.Msg, bool) {
-	ret, ok := s.Domain2IP.Load(domain)
+	if req.Question[0].Qtype == dns.TypePTR {
+		return s.lookUpPTRInCustom(domain, req)
+	}
+
+	// names in domain2ip and hosts are lower case, the query may be in any case like 0x20 randomized ones
+	ret, ok := s.rules.Load().domain2IP[strings.ToLower(domain)]
 	if !ok {
 		return nil, false
 	}
@@ -197,7 +262,7 @@ func (s *Server) lookUpInCustom(domain string, req *dns.Msg) (*dns.Msg, bool) {
 
 	qType := req.Question[0].Qtype
 
-	allIPs := strings.Split(ret.(string), ";")
+	allIPs := strings.Split(ret, ";")
 
 	var useIPs []string
 	var format string
@@ -267,7 +332,7 @@ func (s *Server) newID() uint32 {
 
 func (s *Server) isReplyIPChn(reply *dns.Msg) bool {
 	for _, ip := range replyIP(reply) {
-		contain, err := s.ChinaCIDR.Contains(ip)
+		contain, err := s.rules.Load().chinaCIDR.Contains(ip)
 		if err != nil {
 			logrus.WithError(err).WithField("ip", ip.String()).Error("ChinaCIDR.Contains")
 			return false
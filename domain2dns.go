@@ -0,0 +1,55 @@
+package chinadns
+
+import (
+	"fmt"
+	"strings"
+)
+
+// WithDomain2DNS sets the upstreams of domain suffixes, like the stub zones of corp.example.com or 168.192.in-addr.arpa,
+// which are checked before policies.
+func WithDomain2DNS(domain2dns map[string][]string) ServerOption {
+	return func(o *serverOptions) error {
+		for zone, schemas := range domain2dns {
+			zone = strings.ToLower(strings.Trim(zone, "."))
+			if zone == "" {
+				return fmt.Errorf("domain2dns:empty domain")
+			}
+			if len(schemas) == 0 {
+				return fmt.Errorf("domain2dns[%s]:no upstream", zone)
+			}
+
+			var servers resolverList
+			for _, schema := range schemas {
+				r, err := ParseResolver(schema, false)
+				if err != nil {
+					return fmt.Errorf("domain2dns[%s]:%w", zone, err)
+				}
+				servers = uniqueAppendResolver(servers, r)
+			}
+			if o.rules.domain2DNS == nil {
+				o.rules.domain2DNS = make(map[string]resolverList)
+			}
+			o.rules.domain2DNS[zone] = servers
+		}
+		return nil
+	}
+}
+
+// stubZone returns the most specific domain2dns suffix of domain and its upstreams
+func (r *ruleSet) stubZone(domain string) (string, resolverList, bool) {
+	if len(r.domain2DNS) == 0 {
+		return "", nil, false
+	}
+
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for {
+		if servers, ok := r.domain2DNS[domain]; ok {
+			return domain, servers, true
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			return "", nil, false
+		}
+		domain = domain[i+1:]
+	}
+}
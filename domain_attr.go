@@ -24,11 +24,15 @@ func (s *Server) isAboardResolver(r *Resolver) bool {
 	return false
 }
 
-func (s *Server) getResolverAttr(resolver *Resolver) (ret []DomainAttr) {
+// getResolverAttr returns the attrs of resolver, which are overridden by the client group if set
+func (s *Server) getResolverAttr(resolver *Resolver, g *clientGroup) (ret []DomainAttr) {
 	if resolver == nil {
 		return nil
 	}
 	if s.isAboardResolver(resolver) {
+		if g != nil && g.abroadAttr != nil {
+			return g.abroadAttr
+		}
 		return s.DNSAbroadAttr
 	}
 
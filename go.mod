@@ -4,12 +4,33 @@ go 1.21
 
 require (
 	github.com/0990/socks5 v1.0.4
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/maxmind/mmdbwriter v1.0.0
 	github.com/miekg/dns v1.1.50
 	github.com/natefinch/lumberjack v2.0.0+incompatible
+	github.com/oschwald/maxminddb-golang v1.12.0
+	github.com/quic-go/quic-go v0.41.0
 	github.com/sirupsen/logrus v1.8.1
 	github.com/yl2chen/cidranger v1.0.2
-	golang.org/x/net v0.11.0 // indirect
-	golang.org/x/sync v0.1.0
-	golang.org/x/sys v0.9.0
+	golang.org/x/net v0.11.0
+	golang.org/x/sync v0.2.0
+	golang.org/x/sys v0.10.0
+	google.golang.org/protobuf v1.33.0
+)
+
+require (
+	github.com/BurntSushi/toml v1.6.0 // indirect
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
+	github.com/quic-go/qpack v0.4.0 // indirect
+	go.uber.org/mock v0.3.0 // indirect
+	go4.org/netipx v0.0.0-20220812043211-3cc044ffd68d // indirect
+	golang.org/x/crypto v0.10.0 // indirect
+	golang.org/x/exp v0.0.0-20221205204356-47842c84f3db // indirect
+	golang.org/x/mod v0.11.0 // indirect
+	golang.org/x/text v0.10.0 // indirect
+	golang.org/x/tools v0.9.1 // indirect
+	gopkg.in/natefinch/lumberjack.v2 v2.2.1 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
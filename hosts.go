@@ -0,0 +1,70 @@
+package chinadns
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"strings"
+)
+
+// WithHosts reads the files in /etc/hosts format, names in them are answered like domain2ip, which takes precedence.
+func WithHosts(paths []string) ServerOption {
+	return func(o *serverOptions) error {
+		for _, path := range paths {
+			if err := addHostsFile(o, path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addHostsFile adds lines like "192.168.1.1 router router.lan # comment", ips of the same name are merged
+func addHostsFile(o *serverOptions, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("fail to open hosts file: %w", err)
+	}
+	defer file.Close()
+
+	if o.rules.hosts == nil {
+		o.rules.hosts = make(map[string][]string)
+	}
+
+	var line int
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line++
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			// such as fe80::1%lo0, which can't be answered
+			logrus.WithField("file", fmt.Sprintf("%s:%d", path, line)).Warnf("invalid ip %s in hosts", fields[0])
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			o.rules.hosts[name] = uniqueAppendString(o.rules.hosts[name], ip.String())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("fail to scan hosts file %s: %w", path, err)
+	}
+	return nil
+}
+
+// mergeHosts adds names in hosts files to domain2ip unless they are configured there
+func mergeHosts(domain2IP map[string]string, hosts map[string][]string) {
+	for name, ips := range hosts {
+		if _, ok := domain2IP[name]; !ok {
+			domain2IP[name] = strings.Join(ips, ";")
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package chinadns
+
+import (
+	"github.com/miekg/dns"
+	"path/filepath"
+	"testing"
+)
+
+func TestWithHosts(t *testing.T) {
+	dir := t.TempDir()
+	hosts := writeTestFile(t, dir, "hosts", `# local names
+127.0.0.1	localhost
+::1		localhost ip6-localhost
+fe80::1%lo0	localhost
+192.168.1.1 Router router.lan # the router
+192.168.1.2 nas.lan
+192.168.1.3 nas.lan
+`)
+	rules, err := buildRules(testRuleOptions(t, dir,
+		WithHosts([]string{hosts}),
+		WithDomain2IP(map[string]string{"Router.LAN.": "10.0.0.1"}),
+	)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tbls := []struct {
+		domain string
+		ips    string
+	}{
+		{"localhost", "127.0.0.1;::1"},
+		{"ip6-localhost", "::1"},
+		{"router", "192.168.1.1"},
+		{"router.lan", "10.0.0.1"},
+		{"nas.lan", "192.168.1.2;192.168.1.3"},
+	}
+	for _, v := range tbls {
+		if ips := rules.domain2IP[v.domain]; ips != v.ips {
+			t.Errorf("%s ips:%s expect:%s", v.domain, ips, v.ips)
+		}
+	}
+
+	s := &Server{}
+	s.rules.Store(rules)
+	for _, v := range []struct {
+		name   string
+		qtype  uint16
+		answer int
+	}{
+		{"nas.lan.", dns.TypeA, 2},
+		// 0x20 randomized
+		{"NaS.lAn.", dns.TypeA, 2},
+		{"Router.LAN.", dns.TypeA, 1},
+		{"localhost.", dns.TypeAAAA, 1},
+		{"3.1.168.192.in-addr.arpa.", dns.TypePTR, 1},
+		{"1.1.168.192.in-addr.arpa.", dns.TypePTR, 1},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.", dns.TypePTR, 2},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(v.name, v.qtype)
+		reply, ok := s.lookUpInCustom(reqDomain(req), req)
+		if !ok || len(reply.Answer) != v.answer {
+			t.Errorf("%s reply:%v expect %d answers", v.name, reply, v.answer)
+		}
+	}
+
+	if route := rules.explain("ROUTER.lan.", dns.TypeA, nil); route.Route != RouteDomain2IP || route.IP != "10.0.0.1" {
+		t.Errorf("route:%+v expect domain2ip 10.0.0.1", route)
+	}
+
+	if _, err := buildRules(WithHosts([]string{filepath.Join(dir, "none")})); err == nil {
+		t.Errorf("expect error of missing hosts file")
+	}
+}
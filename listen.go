@@ -1,6 +1,12 @@
 package chinadns
 
-import "github.com/miekg/dns"
+import (
+	"crypto/tls"
+	"github.com/0990/chinadns/pkg/doq"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+)
 
 func runUDPServer(s *dns.Server) error {
 	pc, err := listenUDP(s.Net, s.Addr, s.ReusePort)
@@ -21,3 +27,39 @@ func runTCPServer(s *dns.Server) error {
 	s.Listener = l
 	return s.ActivateAndServe()
 }
+
+func runTLSServer(s *dns.Server) error {
+	l, err := listenTCP("tcp", s.Addr, s.ReusePort)
+	if err != nil {
+		return err
+	}
+	return serveTLS(s, l)
+}
+
+// serveTLS serves DoT on the tcp listener
+func serveTLS(s *dns.Server, l net.Listener) error {
+	s.Listener = tls.NewListener(l, s.TLSConfig)
+	return s.ActivateAndServe()
+}
+
+func runDoQServer(s *doq.Server) error {
+	pc, err := listenUDP("udp", s.Addr, true)
+	if err != nil {
+		return err
+	}
+
+	defer pc.Close()
+	return s.Serve(pc)
+}
+
+func runDoHServer(s *http.Server) error {
+	l, err := listenTCP("tcp", s.Addr, false)
+	if err != nil {
+		return err
+	}
+
+	if s.TLSConfig == nil {
+		return s.Serve(l)
+	}
+	return s.ServeTLS(l, "", "")
+}
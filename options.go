@@ -3,23 +3,54 @@ package chinadns
 import (
 	"bufio"
 	"fmt"
+	"github.com/0990/chinadns/pkg/doh"
+	"github.com/0990/chinadns/pkg/geodata"
 	"github.com/0990/chinadns/pkg/matcher"
 	"github.com/yl2chen/cidranger"
 	"net"
 	"os"
 	"strings"
-	"sync"
 )
 
+const defaultStaleMaxAge = 86400
+
+const defaultNegativeTTL = 300
+
+const defaultCacheSnapshotSec = 600
+
+// geoIPPrefix is the prefix of China route list referencing a list in geoip.dat, like geoip:cn
+const geoIPPrefix = "geoip:"
+
 // ServerOption provides ChinaDNS server options. Please use WithXXX functions to generate Options.
 type ServerOption func(*serverOptions) error
 
 type serverOptions struct {
 	Listen string // Listening address, such as `[::]:53`, `0.0.0.0:53`
 
-	CacheExpireSec int64
+	DoHListen string // DoH listening address, disabled when empty
+	DoHPath   string // DoH endpoint path, `/dns-query` by default
+	DoTListen string // DoT listening address, disabled when empty
+	DoQListen string // DoQ listening address, disabled when empty
+
+	TLSCertFile string // Certificate of encrypted listeners
+	TLSKeyFile  string
+
+	CacheExpireSec int64 // max cache time, cache is disabled when <=0
+	CacheMinTTL    int64 // min cache time
+
+	CacheServeStale  bool  // serve expired cache when upstreams fail, RFC 8767
+	CacheStaleMaxAge int64 // how long an expired cache can be served
+	CacheOptimistic  bool  // serve expired cache at once, and refresh it in background
+
+	CachePrefetchHits int // prefetch the cache hit more than CachePrefetchHits times before it expires, disabled when <=0
 
-	Domain2IP sync.Map
+	CacheNegativeTTL int64 // max cache time of NXDOMAIN/NODATA replies, disabled when <=0
+
+	CacheMaxEntries int   // max count of cache entries, the least recently used ones are evicted when full
+	CacheMaxBytes   int64 // max memory of cache entries, no limit when <=0
+
+	CacheFile        string // cache is saved to the file on shutdown and loaded on startup
+	CacheSnapshotSec int    // interval of saving cache to file, disabled when <=0
 
 	DNSChinaServers   resolverList // DNS servers which can be trusted
 	DNSAbroadServers  resolverList // DNS servers which may return polluted results
@@ -28,16 +59,25 @@ type serverOptions struct {
 	DNSAbroadAttr   []DomainAttr
 	DNSAdBlockJudge *AdBlockJudge
 
-	ChinaCIDR cidranger.Ranger
+	GeoSiteFile string // file of geosite:xxx in domain rules
+	GeoIPFile   string // file of geoip:xxx in China route list
+
+	ChinaCountries []string // country codes of networks used from mmdb file in China route list
+
+	DomainUpstream bool // use the upstream in domain rules, like server=/domain/114.114.114.114 of dnsmasq
 
-	chnDomainMatcher matcher.Matcher
-	gfwDomainMatcher matcher.Matcher
+	rules *ruleSet // rules built by options, which is the initial rules of server
 }
 
 func newServerOptions() *serverOptions {
 	return &serverOptions{
 		Listen:          "[::]:53",
+		DoHPath:         doh.DefaultPath,
 		DNSAdBlockJudge: NewAdBlockJudge(nil),
+		GeoSiteFile:     "geosite.dat",
+		GeoIPFile:       "geoip.dat",
+		ChinaCountries:  []string{"CN"},
+		rules:           &ruleSet{domain2IP: make(map[string]string)},
 	}
 }
 
@@ -48,6 +88,44 @@ func WithListenAddr(addr string) ServerOption {
 	}
 }
 
+func WithDoHListen(addr, path string) ServerOption {
+	return func(o *serverOptions) error {
+		o.DoHListen = addr
+		if path != "" {
+			if !strings.HasPrefix(path, "/") {
+				return fmt.Errorf("invalid doh path %s", path)
+			}
+			o.DoHPath = path
+		}
+		return nil
+	}
+}
+
+func WithDoTListen(addr string) ServerOption {
+	return func(o *serverOptions) error {
+		o.DoTListen = addr
+		return nil
+	}
+}
+
+func WithDoQListen(addr string) ServerOption {
+	return func(o *serverOptions) error {
+		o.DoQListen = addr
+		return nil
+	}
+}
+
+func WithTLSCert(certFile, keyFile string) ServerOption {
+	return func(o *serverOptions) error {
+		if (certFile == "") != (keyFile == "") {
+			return fmt.Errorf("both tls cert and key are required")
+		}
+		o.TLSCertFile = certFile
+		o.TLSKeyFile = keyFile
+		return nil
+	}
+}
+
 func WithCacheExpireSec(sec int) ServerOption {
 	return func(o *serverOptions) error {
 		o.CacheExpireSec = int64(sec)
@@ -55,10 +133,78 @@ func WithCacheExpireSec(sec int) ServerOption {
 	}
 }
 
+func WithCacheMinTTL(sec int) ServerOption {
+	return func(o *serverOptions) error {
+		o.CacheMinTTL = int64(sec)
+		return nil
+	}
+}
+
+// WithCacheServeStale enables serve-stale, maxAgeSec is one day by default.
+// When optimistic, expired cache is returned immediately while refreshing in background,
+// otherwise it's only returned when all upstreams fail.
+func WithCacheServeStale(enable bool, maxAgeSec int, optimistic bool) ServerOption {
+	return func(o *serverOptions) error {
+		if !enable {
+			return nil
+		}
+		if maxAgeSec <= 0 {
+			maxAgeSec = defaultStaleMaxAge
+		}
+		o.CacheServeStale = true
+		o.CacheStaleMaxAge = int64(maxAgeSec)
+		o.CacheOptimistic = optimistic
+		return nil
+	}
+}
+
+func WithCachePrefetch(hits int) ServerOption {
+	return func(o *serverOptions) error {
+		o.CachePrefetchHits = hits
+		return nil
+	}
+}
+
+// WithCacheNegativeTTL caps the cache time of NXDOMAIN/NODATA replies, which is the SOA minimum by RFC 2308.
+// It's defaultNegativeTTL when sec==0, and negative caching is disabled when sec<0.
+func WithCacheNegativeTTL(sec int) ServerOption {
+	return func(o *serverOptions) error {
+		if sec == 0 {
+			sec = defaultNegativeTTL
+		}
+		o.CacheNegativeTTL = int64(sec)
+		return nil
+	}
+}
+
+// WithCacheMaxSize limits the cache by count of entries and memory in bytes,
+// cache.DefaultMaxEntries is used when entries<=0, no memory limit when bytes<=0.
+func WithCacheMaxSize(entries int, bytes int64) ServerOption {
+	return func(o *serverOptions) error {
+		o.CacheMaxEntries = entries
+		o.CacheMaxBytes = bytes
+		return nil
+	}
+}
+
+// WithCacheFile persists cache to file, it's saved every snapshotSec seconds besides on shutdown.
+// snapshotSec is defaultCacheSnapshotSec when 0, and periodic snapshot is disabled when snapshotSec<0.
+func WithCacheFile(file string, snapshotSec int) ServerOption {
+	return func(o *serverOptions) error {
+		if snapshotSec == 0 {
+			snapshotSec = defaultCacheSnapshotSec
+		}
+		o.CacheFile = file
+		o.CacheSnapshotSec = snapshotSec
+		return nil
+	}
+}
+
 func WithDomain2IP(domain2ip map[string]string) ServerOption {
 	return func(o *serverOptions) error {
+		// names are matched case-insensitively like hosts
 		for k, v := range domain2ip {
-			o.Domain2IP.Store(k, v)
+			o.rules.domain2IP[strings.ToLower(strings.TrimSuffix(k, "."))] = v
 		}
 		return nil
 	}
@@ -66,16 +212,19 @@ func WithDomain2IP(domain2ip map[string]string) ServerOption {
 
 func WithDNSAboardAttr(attr string) ServerOption {
 	return func(o *serverOptions) error {
-		attrs := strings.Split(attr, ";")
+		o.DNSAbroadAttr = parseDomainAttrs(attr)
+		return nil
+	}
+}
 
-		var domainAttrs []DomainAttr
-		for _, v := range attrs {
-			domainAttrs = append(domainAttrs, toDomainAttr(v))
-		}
+func parseDomainAttrs(attr string) []DomainAttr {
+	attrs := strings.Split(attr, ";")
 
-		o.DNSAbroadAttr = domainAttrs
-		return nil
+	var domainAttrs []DomainAttr
+	for _, v := range attrs {
+		domainAttrs = append(domainAttrs, toDomainAttr(v))
 	}
+	return domainAttrs
 }
 
 func WithDNS(dnsChina, dnsAbroad []string, dnsAdBlock []string) ServerOption {
@@ -122,7 +271,14 @@ func WithCHNFile(paths []string) ServerOption {
 		}
 
 		for _, path := range paths {
-			err := addCHNFile(o, path)
+			var err error
+			if strings.HasPrefix(path, geoIPPrefix) {
+				err = addGeoIP(o, path)
+			} else if geodata.IsMMDB(path) {
+				err = addMMDB(o, path)
+			} else {
+				err = addCHNFile(o, path)
+			}
 			if err != nil {
 				return err
 			}
@@ -131,6 +287,37 @@ func WithCHNFile(paths []string) ServerOption {
 	}
 }
 
+// addGeoIP adds networks of geoip:code in geoip file
+func addGeoIP(o *serverOptions, ref string) error {
+	networks, err := geodata.LoadGeoIP(o.GeoIPFile, strings.TrimPrefix(ref, geoIPPrefix))
+	if err != nil {
+		return err
+	}
+	return addCHNNetworks(o, networks)
+}
+
+// addMMDB adds networks located in ChinaCountries in mmdb file, like GeoLite2-Country.mmdb
+func addMMDB(o *serverOptions, path string) error {
+	networks, err := geodata.LoadMMDB(path, o.ChinaCountries)
+	if err != nil {
+		return fmt.Errorf("fail to read China route mmdb %s: %w", path, err)
+	}
+	return addCHNNetworks(o, networks)
+}
+
+func addCHNNetworks(o *serverOptions, networks []*net.IPNet) error {
+	if o.rules.chinaCIDR == nil {
+		o.rules.chinaCIDR = cidranger.NewPCTrieRanger()
+	}
+	for _, network := range networks {
+		if err := o.rules.chinaCIDR.Insert(cidranger.NewBasicRangerEntry(*network)); err != nil {
+			return fmt.Errorf("insert %s as CIDR failed: %v", network, err.Error())
+		}
+		o.rules.chinaCIDRLen++
+	}
+	return nil
+}
+
 func addCHNFile(o *serverOptions, path string) error {
 	file, err := os.Open(path)
 	if err != nil {
@@ -139,8 +326,8 @@ func addCHNFile(o *serverOptions, path string) error {
 	}
 	defer file.Close()
 
-	if o.ChinaCIDR == nil {
-		o.ChinaCIDR = cidranger.NewPCTrieRanger()
+	if o.rules.chinaCIDR == nil {
+		o.rules.chinaCIDR = cidranger.NewPCTrieRanger()
 	}
 
 	scanner := bufio.NewScanner(file)
@@ -149,10 +336,11 @@ func addCHNFile(o *serverOptions, path string) error {
 		if err != nil {
 			return fmt.Errorf("parse %s as CIDR failed: %v", scanner.Text(), err.Error())
 		}
-		err = o.ChinaCIDR.Insert(cidranger.NewBasicRangerEntry(*network))
+		err = o.rules.chinaCIDR.Insert(cidranger.NewBasicRangerEntry(*network))
 		if err != nil {
 			return fmt.Errorf("insert %s as CIDR failed: %v", scanner.Text(), err.Error())
 		}
+		o.rules.chinaCIDRLen++
 	}
 	if err := scanner.Err(); err != nil {
 		return fmt.Errorf("fail to scan china route list: %v", err.Error())
@@ -167,11 +355,20 @@ func WithChnDomain(paths []string) ServerOption {
 			return fmt.Errorf("empty for Gfw domain list")
 		}
 
-		m, err := matcher.New("debug", paths...)
+		m, err := newDomainMatcher(o, paths)
 		if err != nil {
 			return err
 		}
-		o.chnDomainMatcher = m
+		o.rules.chnDomainMatcher = m
+		return nil
+	}
+}
+
+// WithDomainUpstream queries domains by the upstream in their rules instead of dns-china or dns-abroad,
+// such as server=/domain/114.114.114.114 of dnsmasq config.
+func WithDomainUpstream(enable bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.DomainUpstream = enable
 		return nil
 	}
 }
@@ -182,11 +379,64 @@ func WithGfwDomain(paths []string) ServerOption {
 			return fmt.Errorf("empty for Gfw domain list")
 		}
 
-		m, err := matcher.New("debug", paths...)
+		m, err := newDomainMatcher(o, paths)
 		if err != nil {
 			return err
 		}
-		o.gfwDomainMatcher = m
+		o.rules.gfwDomainMatcher = m
+		return nil
+	}
+}
+
+// newDomainMatcher creates matcher of domain list files, and lists in geosite file referenced by geosite:xxx
+func newDomainMatcher(o *serverOptions, paths []string) (matcher.Matcher, error) {
+	var (
+		files []string
+		ms    []matcher.Matcher
+	)
+	for _, path := range paths {
+		if !matcher.IsGeoSite(path) {
+			files = append(files, path)
+			continue
+		}
+		m, err := matcher.NewGeoSiteMatcher(o.GeoSiteFile, path)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+
+	if len(files) > 0 {
+		m, err := matcher.New("rule", files...)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return matcher.NewCombineMatcher(ms...), nil
+}
+
+// WithChinaCountries sets the country codes whose networks are used as China route in mmdb file, default is CN.
+// It must be applied before WithCHNFile.
+func WithChinaCountries(codes []string) ServerOption {
+	return func(o *serverOptions) error {
+		if len(codes) > 0 {
+			o.ChinaCountries = codes
+		}
+		return nil
+	}
+}
+
+// WithGeoData sets the geosite.dat and geoip.dat file referenced by geosite:xxx and geoip:xxx in rules,
+// it must be applied before the rule options. Default files are used when empty.
+func WithGeoData(geoSite, geoIP string) ServerOption {
+	return func(o *serverOptions) error {
+		if geoSite != "" {
+			o.GeoSiteFile = geoSite
+		}
+		if geoIP != "" {
+			o.GeoIPFile = geoIP
+		}
 		return nil
 	}
 }
@@ -2,112 +2,255 @@ package cache
 
 import (
 	"github.com/miekg/dns"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type DNSCache interface {
-	Set(q dns.Question, msg any)
-	Get(q dns.Question) (any, bool)
+	Set(q dns.Question, v any, ttl time.Duration)
+	// Get returns the item which is not expired, and counts a hit
+	Get(q dns.Question) (Item, bool)
+	// GetStale returns the item even if it's expired, as long as it's expired no longer than the max stale age.
+	// It doesn't count a hit.
+	GetStale(q dns.Question) (Item, bool)
+	// SetItem stores the item with its own lifetime, which is used to restore items, outdated item is dropped
+	SetItem(q dns.Question, item Item)
+	// Range calls f for every item which is not outdated, it stops when f returns false
+	Range(f func(q dns.Question, item Item) bool)
+	Delete(q dns.Question) bool
+	// Flush removes all items
+	Flush()
 	Len() int
+	Stats() Stats
 }
 
-const DNSCache_TriggerGCCount = 1000
+// Stats is the counters of cache, a miss is counted when Get fails, even if the stale one is got later.
+type Stats struct {
+	Len    int    `json:"len"`
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
 
-type dnsCache struct {
-	sync.RWMutex
-	cache     map[dns.Question]dnsCacheV
-	expireSec int64
+// Item is a cached value with its lifetime.
+type Item struct {
+	Value   any
+	Created time.Time
+	Expire  time.Time
+	Hits    uint32 // times the item has been got by Get in its lifetime
 }
 
-type dnsCacheV struct {
-	lr          any
-	createdTime time.Time
+// TTL returns the whole lifetime of the item.
+func (i Item) TTL() time.Duration {
+	return i.Expire.Sub(i.Created)
 }
 
-func NewDNSCache(expireSec int64) DNSCache {
-	if expireSec <= 0 {
-		return &dnsCacheNone{}
-	}
+// Elapsed returns how long the item has been cached.
+func (i Item) Elapsed(now time.Time) time.Duration {
+	return now.Sub(i.Created)
+}
 
-	return &dnsCache{
-		RWMutex:   sync.RWMutex{},
-		cache:     make(map[dns.Question]dnsCacheV),
-		expireSec: expireSec,
-	}
+// Remaining returns how long the item is still valid.
+func (i Item) Remaining(now time.Time) time.Duration {
+	return i.Expire.Sub(now)
+}
+
+func (i Item) IsExpired(now time.Time) bool {
+	return !now.Before(i.Expire)
 }
 
-func (p *dnsCache) Set(q dns.Question, lr any) {
-	p.set(q, lr)
-	p.checkGC()
+// Sizer is implemented by values which know their memory size, it's used to limit the cache size in bytes.
+type Sizer interface {
+	Size() int
 }
 
-func (p *dnsCache) set(q dns.Question, lr any) {
-	p.Lock()
-	defer p.Unlock()
+const DefaultMaxEntries = 100000
 
-	p.cache[q] = dnsCacheV{
-		lr:          lr,
-		createdTime: time.Now(),
+type Option func(*dnsCache)
+
+// WithMinTTL set the lower bound of cache time, records with smaller ttl are cached for minTTL.
+func WithMinTTL(minTTL time.Duration) Option {
+	return func(p *dnsCache) {
+		p.minTTL = minTTL
 	}
 }
 
-func (p *dnsCache) Get(q dns.Question) (any, bool) {
-	p.RLock()
-	defer p.RUnlock()
+// WithServeStale keeps expired items for maxStale, which can be got by GetStale, RFC 8767.
+func WithServeStale(maxStale time.Duration) Option {
+	return func(p *dnsCache) {
+		p.maxStale = maxStale
+	}
+}
 
-	v, ok := p.cache[q]
-	if !ok {
-		return nil, false
+// WithMaxEntries limits the count of items, DefaultMaxEntries is used when n<=0.
+func WithMaxEntries(n int) Option {
+	return func(p *dnsCache) {
+		p.maxEntries = n
 	}
+}
 
-	if p.isExpire(v, time.Now()) {
-		return nil, false
+// WithMaxBytes limits the memory size of items, no limit when n<=0.
+func WithMaxBytes(n int64) Option {
+	return func(p *dnsCache) {
+		p.maxBytes = n
 	}
+}
+
+// dnsCache is a sharded LRU cache, the least recently used items are evicted when it's full,
+// outdated items are removed when got or evicted.
+type dnsCache struct {
+	shards []*shard
+
+	minTTL     time.Duration
+	maxTTL     time.Duration
+	maxStale   time.Duration
+	maxEntries int
+	maxBytes   int64
 
-	return v.lr, true
+	hits   atomic.Uint64
+	misses atomic.Uint64
 }
 
-func (p *dnsCache) Len() int {
-	p.Lock()
-	defer p.Unlock()
-	return len(p.cache)
+// NewDNSCache creates a cache whose items expire after their ttl, clamped to [minTTL,maxTTL].
+// Cache is disabled when maxTTL<=0.
+func NewDNSCache(maxTTL time.Duration, opts ...Option) DNSCache {
+	if maxTTL <= 0 {
+		return &dnsCacheNone{}
+	}
+
+	p := &dnsCache{
+		maxTTL: maxTTL,
+	}
+	for _, f := range opts {
+		f(p)
+	}
+	if p.maxEntries <= 0 {
+		p.maxEntries = DefaultMaxEntries
+	}
+
+	p.shards = make([]*shard, shardCount)
+	for i := range p.shards {
+		p.shards[i] = newShard(
+			(p.maxEntries+shardCount-1)/shardCount,
+			(p.maxBytes+shardCount-1)/shardCount,
+			p.maxStale,
+		)
+	}
+	return p
 }
 
-func (p *dnsCache) checkGC() {
-	p.Lock()
-	defer p.Unlock()
+func (p *dnsCache) Set(q dns.Question, v any, ttl time.Duration) {
+	if ttl < p.minTTL {
+		ttl = p.minTTL
+	}
+	if ttl > p.maxTTL {
+		ttl = p.maxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	p.shard(q).set(q, Item{
+		Value:   v,
+		Created: now,
+		Expire:  now.Add(ttl),
+	})
+}
 
-	if len(p.cache) < DNSCache_TriggerGCCount {
+func (p *dnsCache) SetItem(q dns.Question, item Item) {
+	s := p.shard(q)
+	if s.isOutdated(item, time.Now()) {
 		return
 	}
+	item.Hits = 0
+	s.set(q, item)
+}
 
+func (p *dnsCache) Range(f func(q dns.Question, item Item) bool) {
 	now := time.Now()
-	for k, v := range p.cache {
-		if p.isExpire(v, now) {
-			delete(p.cache, k)
+	for _, s := range p.shards {
+		if !s.rangeItems(now, f) {
+			return
 		}
 	}
 }
 
-func (p *dnsCache) isExpire(dnsCacheV dnsCacheV, now time.Time) bool {
-	if now.Sub(dnsCacheV.createdTime)/time.Second > time.Duration(p.expireSec) {
-		return true
+func (p *dnsCache) Get(q dns.Question) (Item, bool) {
+	item, ok := p.shard(q).get(q, time.Now(), false)
+	if ok {
+		p.hits.Add(1)
+	} else {
+		p.misses.Add(1)
 	}
-	return false
+	return item, ok
+}
+
+func (p *dnsCache) GetStale(q dns.Question) (Item, bool) {
+	return p.shard(q).get(q, time.Now(), true)
+}
+
+func (p *dnsCache) Delete(q dns.Question) bool {
+	return p.shard(q).delete(q)
+}
+
+func (p *dnsCache) Flush() {
+	for _, s := range p.shards {
+		s.flush()
+	}
+}
+
+func (p *dnsCache) Stats() Stats {
+	return Stats{
+		Len:    p.Len(),
+		Hits:   p.hits.Load(),
+		Misses: p.misses.Load(),
+	}
+}
+
+func (p *dnsCache) Len() int {
+	var n int
+	for _, s := range p.shards {
+		n += s.len()
+	}
+	return n
+}
+
+func (p *dnsCache) shard(q dns.Question) *shard {
+	return p.shards[shardIndex(q)]
 }
 
 type dnsCacheNone struct {
 }
 
-func (p *dnsCacheNone) Set(q dns.Question, lr any) {
+func (p *dnsCacheNone) Set(q dns.Question, v any, ttl time.Duration) {
 	return
 }
 
-func (p *dnsCacheNone) Get(q dns.Question) (any, bool) {
-	return nil, false
+func (p *dnsCacheNone) Get(q dns.Question) (Item, bool) {
+	return Item{}, false
+}
+
+func (p *dnsCacheNone) GetStale(q dns.Question) (Item, bool) {
+	return Item{}, false
+}
+
+func (p *dnsCacheNone) SetItem(q dns.Question, item Item) {
+}
+
+func (p *dnsCacheNone) Range(f func(q dns.Question, item Item) bool) {
+}
+
+func (p *dnsCacheNone) Delete(q dns.Question) bool {
+	return false
+}
+
+func (p *dnsCacheNone) Flush() {
 }
 
 func (p *dnsCacheNone) Len() int {
 	return 0
 }
+
+func (p *dnsCacheNone) Stats() Stats {
+	return Stats{}
+}
@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type sizedValue int
+
+func (v sizedValue) Size() int {
+	return int(v)
+}
+
+func question(i int) dns.Question {
+	return dns.Question{Name: fmt.Sprintf("www%d.example.com.", i), Qtype: dns.TypeA, Qclass: dns.ClassINET}
+}
+
+func TestDNSCache_MaxEntries(t *testing.T) {
+	c := NewDNSCache(time.Minute, WithMaxEntries(shardCount*10))
+	for i := 0; i < shardCount*100; i++ {
+		c.Set(question(i), i, time.Minute)
+	}
+	if n := c.Len(); n > shardCount*10 {
+		t.Fatalf("Len %d,expect <=%d", n, shardCount*10)
+	}
+
+	// the latest one is never evicted
+	last := shardCount*100 - 1
+	if item, ok := c.Get(question(last)); !ok || item.Value.(int) != last {
+		t.Fatalf("latest entry evicted")
+	}
+}
+
+func TestDNSCache_MaxBytes(t *testing.T) {
+	const valueSize = 1000
+	maxBytes := int64(shardCount * 4 * (valueSize + entryOverhead + 20))
+	c := NewDNSCache(time.Minute, WithMaxBytes(maxBytes))
+	for i := 0; i < shardCount*100; i++ {
+		c.Set(question(i), sizedValue(valueSize), time.Minute)
+	}
+
+	p := c.(*dnsCache)
+	var bytes int64
+	for _, s := range p.shards {
+		bytes += s.bytes
+	}
+	if bytes > maxBytes {
+		t.Fatalf("bytes %d,expect <=%d", bytes, maxBytes)
+	}
+	if c.Len() == 0 {
+		t.Fatalf("all entries evicted")
+	}
+}
+
+func TestDNSCache_LRU(t *testing.T) {
+	c := NewDNSCache(time.Minute, WithMaxEntries(shardCount*2))
+	p := c.(*dnsCache)
+
+	// find three questions in the same shard, whose limit is 2
+	var qs []dns.Question
+	for i := 0; len(qs) < 3; i++ {
+		if q := question(i); p.shard(q) == p.shards[0] {
+			qs = append(qs, q)
+		}
+	}
+
+	c.Set(qs[0], 0, time.Minute)
+	c.Set(qs[1], 1, time.Minute)
+	c.Get(qs[0])
+	c.Set(qs[2], 2, time.Minute)
+
+	if _, ok := c.Get(qs[1]); ok {
+		t.Errorf("least recently used entry not evicted")
+	}
+	if _, ok := c.Get(qs[0]); !ok {
+		t.Errorf("recently used entry evicted")
+	}
+}
+
+func TestDNSCache_Expire(t *testing.T) {
+	c := NewDNSCache(time.Minute, WithServeStale(time.Hour))
+	p := c.(*dnsCache)
+	q := question(0)
+
+	now := time.Now()
+	p.shard(q).set(q, Item{Value: 1, Created: now.Add(-2 * time.Minute), Expire: now.Add(-time.Minute)})
+	if _, ok := c.Get(q); ok {
+		t.Errorf("expired entry got")
+	}
+	if _, ok := c.GetStale(q); !ok {
+		t.Errorf("stale entry not got")
+	}
+
+	p.shard(q).set(q, Item{Value: 1, Created: now.Add(-2 * time.Hour), Expire: now.Add(-time.Hour)})
+	if _, ok := c.GetStale(q); ok {
+		t.Errorf("outdated entry got")
+	}
+	if c.Len() != 0 {
+		t.Errorf("outdated entry not removed")
+	}
+}
+
+func TestDNSCache_Hits(t *testing.T) {
+	c := NewDNSCache(time.Minute)
+	q := question(0)
+	c.Set(q, 1, time.Minute)
+	for i := 1; i <= 3; i++ {
+		item, ok := c.Get(q)
+		if !ok || item.Hits != uint32(i) {
+			t.Fatalf("hits %d,expect %d", item.Hits, i)
+		}
+	}
+
+	// stale gets are not counted
+	if item, _ := c.GetStale(q); item.Hits != 3 {
+		t.Fatalf("hits %d,expect 3", item.Hits)
+	}
+
+	// hits are reset when updated
+	c.Set(q, 2, time.Minute)
+	if item, _ := c.Get(q); item.Hits != 1 {
+		t.Fatalf("hits %d,expect 1", item.Hits)
+	}
+}
+
+func TestDNSCache_Stats(t *testing.T) {
+	c := NewDNSCache(time.Minute)
+	c.Set(question(0), 0, time.Minute)
+	c.Set(question(1), 1, time.Minute)
+	c.Get(question(0))
+	c.Get(question(2))
+
+	if s := c.Stats(); s.Len != 2 || s.Hits != 1 || s.Misses != 1 {
+		t.Fatalf("stats %+v", s)
+	}
+	if !c.Delete(question(0)) || c.Delete(question(0)) {
+		t.Fatalf("delete failed")
+	}
+	c.Flush()
+	if c.Len() != 0 {
+		t.Fatalf("Len %d after flush", c.Len())
+	}
+}
@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"container/list"
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const shardCount = 32
+
+// entryOverhead is the estimated memory of an entry besides its value: list element, map slot, item fields.
+const entryOverhead = 160
+
+var shardSeed = maphash.MakeSeed()
+
+func shardIndex(q dns.Question) int {
+	h := maphash.String(shardSeed, q.Name)
+	h ^= uint64(q.Qtype)<<16 | uint64(q.Qclass)
+	return int(h % shardCount)
+}
+
+type entry struct {
+	key  dns.Question
+	item Item
+	size int64
+	hits atomic.Uint32
+}
+
+func (e *entry) hit() Item {
+	item := e.item
+	item.Hits = e.hits.Add(1)
+	return item
+}
+
+// shard is a LRU list with its own lock, front is the most recently used.
+type shard struct {
+	sync.Mutex
+	items map[dns.Question]*list.Element
+	ll    *list.List
+	bytes int64
+
+	maxEntries int
+	maxBytes   int64
+	maxStale   time.Duration
+}
+
+func newShard(maxEntries int, maxBytes int64, maxStale time.Duration) *shard {
+	return &shard{
+		items:      make(map[dns.Question]*list.Element),
+		ll:         list.New(),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		maxStale:   maxStale,
+	}
+}
+
+func (s *shard) set(q dns.Question, item Item) {
+	e := &entry{
+		key:  q,
+		item: item,
+		size: sizeOf(q, item.Value),
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if el, ok := s.items[q]; ok {
+		s.bytes -= el.Value.(*entry).size
+		el.Value = e
+		s.ll.MoveToFront(el)
+	} else {
+		s.items[q] = s.ll.PushFront(e)
+	}
+	s.bytes += e.size
+
+	for s.ll.Len() > s.maxEntries || (s.maxBytes > 0 && s.bytes > s.maxBytes && s.ll.Len() > 1) {
+		s.removeElement(s.ll.Back())
+	}
+}
+
+// get returns the item unless it's outdated, which is expired longer than maxStale.
+// Expired item is only returned when stale is true.
+func (s *shard) get(q dns.Question, now time.Time, stale bool) (Item, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	el, ok := s.items[q]
+	if !ok {
+		return Item{}, false
+	}
+
+	e := el.Value.(*entry)
+	if s.isOutdated(e.item, now) {
+		s.removeElement(el)
+		return Item{}, false
+	}
+	if !stale && e.item.IsExpired(now) {
+		return Item{}, false
+	}
+
+	s.ll.MoveToFront(el)
+	if stale {
+		// a stale get is not counted, only hits of Get tell whether the item is hot
+		item := e.item
+		item.Hits = e.hits.Load()
+		return item, true
+	}
+	return e.hit(), true
+}
+
+// rangeItems calls f with items which are not outdated, it returns false when f does.
+// Items are copied out first, so f may access the cache.
+func (s *shard) rangeItems(now time.Time, f func(q dns.Question, item Item) bool) bool {
+	s.Lock()
+	entries := make([]*entry, 0, s.ll.Len())
+	for el := s.ll.Front(); el != nil; el = el.Next() {
+		if e := el.Value.(*entry); !s.isOutdated(e.item, now) {
+			entries = append(entries, e)
+		}
+	}
+	s.Unlock()
+
+	for _, e := range entries {
+		item := e.item
+		item.Hits = e.hits.Load()
+		if !f(e.key, item) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *shard) delete(q dns.Question) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	el, ok := s.items[q]
+	if !ok {
+		return false
+	}
+	s.removeElement(el)
+	return true
+}
+
+func (s *shard) flush() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.items = make(map[dns.Question]*list.Element)
+	s.ll.Init()
+	s.bytes = 0
+}
+
+func (s *shard) len() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.ll.Len()
+}
+
+func (s *shard) removeElement(el *list.Element) {
+	e := s.ll.Remove(el).(*entry)
+	delete(s.items, e.key)
+	s.bytes -= e.size
+}
+
+// isOutdated reports whether the item can't be served even as stale
+func (s *shard) isOutdated(v Item, now time.Time) bool {
+	return !now.Before(v.Expire.Add(s.maxStale))
+}
+
+func sizeOf(q dns.Question, v any) int64 {
+	size := int64(entryOverhead + len(q.Name))
+	if sizer, ok := v.(Sizer); ok {
+		size += int64(sizer.Size())
+	}
+	return size
+}
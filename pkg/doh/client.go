@@ -1,14 +1,22 @@
 package doh
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
+	"github.com/0990/chinadns/pkg/util"
 	"github.com/0990/socks5"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -17,12 +25,20 @@ import (
 
 const DoHMediaType = "application/dns-message"
 
+const (
+	MethodGet  = http.MethodGet
+	MethodPost = http.MethodPost
+)
+
 var ErrQueryMyself = errors.New("not allowed to query myself")
 
 type clientOptions struct {
 	Timeout         time.Duration
 	SkipQueryMyself bool
 	Socks5Proxy     string
+	Method          string
+	HTTP3           bool
+	TLSConfig       *tls.Config
 }
 
 type ClientOption func(*clientOptions)
@@ -50,57 +66,175 @@ func WithSkipQueryMySelf(skip bool) ClientOption {
 	}
 }
 
+// WithMethod set the http method of DoH request, GET or POST(RFC8484 section 4.1), GET by default
+func WithMethod(method string) ClientOption {
+	return func(o *clientOptions) {
+		o.Method = strings.ToUpper(method)
+	}
+}
+
+// WithHTTP3 sends DoH requests over HTTP/3 instead of HTTP/2
+func WithHTTP3(b bool) ClientOption {
+	return func(o *clientOptions) {
+		o.HTTP3 = b
+	}
+}
+
+// WithTLSConfig set the tls config of https connections
+func WithTLSConfig(cfg *tls.Config) ClientOption {
+	return func(o *clientOptions) {
+		o.TLSConfig = cfg
+	}
+}
+
 type Client struct {
 	opt *clientOptions
-	cli *http.Client
+	sc  *socks5.Socks5Client
+
+	sync.Mutex
+	clis map[string]*http.Client // one pooled http client per resolver host
 }
 
 func NewClient(opts ...ClientOption) *Client {
-	o := new(clientOptions)
+	o := &clientOptions{
+		Method: MethodGet,
+	}
 	for _, f := range opts {
 		f(o)
 	}
+	if o.Method != MethodPost {
+		o.Method = MethodGet
+	}
 
-	cli := &http.Client{
-		Timeout: o.Timeout,
+	c := &Client{
+		opt:  o,
+		clis: make(map[string]*http.Client),
 	}
+
 	if o.Socks5Proxy != "" {
-		sc := socks5.NewSocks5Client(socks5.ClientCfg{
+		c.sc = socks5.NewSocks5Client(socks5.ClientCfg{
 			ServerAddr: o.Socks5Proxy,
 			UserName:   "",
 			Password:   "",
 			UDPTimout:  60,
 			TCPTimeout: 60,
 		})
+	}
 
+	return c
+}
+
+func (c *Client) httpClient(host string) *http.Client {
+	c.Lock()
+	defer c.Unlock()
+
+	cli, ok := c.clis[host]
+	if !ok {
 		cli = &http.Client{
-			Timeout: o.Timeout,
-			Transport: &http.Transport{
-				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-					return sc.Dial(network, addr)
-				},
-			},
+			Timeout: c.opt.Timeout,
+		}
+		if c.opt.HTTP3 {
+			cli.Transport = c.newHTTP3Transport()
+		} else {
+			cli.Transport = c.newHTTP2Transport()
 		}
+		c.clis[host] = cli
 	}
+	return cli
+}
 
-	return &Client{
-		opt: o,
-		cli: cli,
+func (c *Client) newHTTP2Transport() http.RoundTripper {
+	t := &http.Transport{
+		Proxy:               nil,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        16,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 5 * time.Second,
+	}
+	if c.opt.TLSConfig != nil {
+		t.TLSClientConfig = c.opt.TLSConfig.Clone()
 	}
+
+	if c.sc != nil {
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			timeout := 10 * time.Second
+			if deadline, ok := ctx.Deadline(); ok && !deadline.IsZero() {
+				timeout = time.Until(deadline)
+			}
+			return c.sc.DialTimeout(network, addr, timeout)
+		}
+	} else {
+		d := &net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}
+		t.DialContext = d.DialContext
+	}
+
+	// send pings on idle connections, so a dead connection is found before it's reused
+	if t2, err := http2.ConfigureTransports(t); err == nil {
+		t2.ReadIdleTimeout = 30 * time.Second
+		t2.PingTimeout = 5 * time.Second
+	} else {
+		logrus.WithError(err).Warn("http2.ConfigureTransports")
+	}
+	return t
+}
+
+func (c *Client) newHTTP3Transport() http.RoundTripper {
+	tlsConf := &tls.Config{}
+	if c.opt.TLSConfig != nil {
+		tlsConf = c.opt.TLSConfig.Clone()
+	}
+	if tlsConf.ClientSessionCache == nil {
+		tlsConf.ClientSessionCache = tls.NewLRUClientSessionCache(16)
+	}
+
+	t := &http3.RoundTripper{
+		TLSClientConfig: tlsConf,
+		QuicConfig: &quic.Config{
+			KeepAlivePeriod: 20 * time.Second,
+			MaxIdleTimeout:  60 * time.Second,
+		},
+	}
+
+	if c.sc != nil {
+		// quic over the UDP ASSOCIATE of socks5 proxy
+		t.Dial = func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			uc, err := c.sc.DialTimeout("udp", addr, 10*time.Second)
+			if err != nil {
+				return nil, err
+			}
+			pc := util.NewPacketConn(uc)
+			qc, err := quic.DialEarly(ctx, pc, pc.RemoteAddr(), tlsCfg, cfg)
+			if err != nil {
+				uc.Close()
+				return nil, err
+			}
+			go func() {
+				<-qc.Context().Done()
+				uc.Close()
+			}()
+			return qc, nil
+		}
+	}
+	return t
 }
 
 func (c *Client) Exchange(ctx context.Context, req *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error) {
 	var (
-		buf, b64 []byte
-		begin    = time.Now()
-		origID   = req.Id
+		buf    []byte
+		begin  = time.Now()
+		origID = req.Id
 	)
 
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, 0, err
+	}
+
 	if c.opt.SkipQueryMyself {
-		u, e := url.Parse(address)
-		if e != nil {
-			return nil, 0, e
-		}
 		if req.Question[0].Name == dns.Fqdn(u.Hostname()) {
 			return nil, 0, ErrQueryMyself
 		}
@@ -109,21 +243,35 @@ func (c *Client) Exchange(ctx context.Context, req *dns.Msg, address string) (r
 	// Set DNS ID as zero accoreding to RFC8484 (cache friendly)
 	req.Id = 0
 	buf, err = req.Pack()
-	b64 = make([]byte, base64.RawURLEncoding.EncodedLen(len(buf)))
+	req.Id = origID
 	if err != nil {
 		return
 	}
-	base64.RawURLEncoding.Encode(b64, buf)
 
-	// No need to use hreq.URL.Query()
-	uri := address + "?dns=" + string(b64)
-	logrus.Debugln("DoH request:", uri)
-	hreq, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
-	if err != nil {
-		return nil, 0, err
+	var hreq *http.Request
+	switch c.opt.Method {
+	case MethodPost:
+		logrus.Debugln("DoH request:", address)
+		hreq, err = http.NewRequestWithContext(ctx, MethodPost, address, bytes.NewReader(buf))
+		if err != nil {
+			return nil, 0, err
+		}
+		hreq.Header.Set("Content-Type", DoHMediaType)
+	default:
+		b64 := make([]byte, base64.RawURLEncoding.EncodedLen(len(buf)))
+		base64.RawURLEncoding.Encode(b64, buf)
+
+		// No need to use hreq.URL.Query()
+		uri := address + "?dns=" + string(b64)
+		logrus.Debugln("DoH request:", uri)
+		hreq, err = http.NewRequestWithContext(ctx, MethodGet, uri, nil)
+		if err != nil {
+			return nil, 0, err
+		}
 	}
 	hreq.Header.Add("Accept", DoHMediaType)
-	resp, err := c.cli.Do(hreq)
+
+	resp, err := c.httpClient(u.Host).Do(hreq)
 	if err != nil {
 		return
 	}
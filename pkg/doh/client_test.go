@@ -0,0 +1,157 @@
+package doh
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// answerA answers every query with 1.2.3.4
+var answerA = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 1.2.3.4")
+	reply.Answer = append(reply.Answer, rr)
+	_ = w.WriteMsg(reply)
+})
+
+// testServer is an in-process DoH server over HTTP/2, recording the requests and new connections
+type testServer struct {
+	*httptest.Server
+	conns int32
+
+	sync.Mutex
+	methods []string
+	protos  []int
+}
+
+func newTestServer(t *testing.T) *testServer {
+	s := &testServer{}
+	h := NewHandler(answerA)
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Lock()
+		s.methods = append(s.methods, r.Method)
+		s.protos = append(s.protos, r.ProtoMajor)
+		s.Unlock()
+		h.ServeHTTP(w, r)
+	}))
+	s.EnableHTTP2 = true
+	s.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&s.conns, 1)
+		}
+	}
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testServer) rootCAs() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+	return pool
+}
+
+func exchange(t *testing.T, c *Client, address string, id uint16) {
+	t.Helper()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.Id = id
+
+	r, _, err := c.Exchange(context.Background(), req, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != id || req.Id != id {
+		t.Errorf("reply id %d,request id %d,expect %d", r.Id, req.Id, id)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+		t.Errorf("unexpected reply %v", r)
+	}
+}
+
+func TestClient_Exchange(t *testing.T) {
+	for _, method := range []string{MethodGet, MethodPost} {
+		s := newTestServer(t)
+		c := NewClient(WithTimeout(time.Second*2), WithMethod(method), WithTLSConfig(&tls.Config{RootCAs: s.rootCAs()}))
+
+		address := s.URL + DefaultPath
+		for i := 0; i < 5; i++ {
+			exchange(t, c, address, uint16(i+1))
+		}
+
+		for i := range s.methods {
+			if s.methods[i] != method || s.protos[i] != 2 {
+				t.Errorf("request %d:%s HTTP/%d,expect %s HTTP/2", i, s.methods[i], s.protos[i], method)
+			}
+		}
+		if n := atomic.LoadInt32(&s.conns); n != 1 {
+			t.Errorf("%s connections %d,expect 1", method, n)
+		}
+		if n := len(c.clis); n != 1 {
+			t.Errorf("%s http clients %d,expect 1", method, n)
+		}
+	}
+}
+
+func TestClient_ExchangeHosts(t *testing.T) {
+	s1, s2 := newTestServer(t), newTestServer(t)
+	pool := s1.rootCAs()
+	pool.AddCert(s2.Certificate())
+	c := NewClient(WithTimeout(time.Second*2), WithTLSConfig(&tls.Config{RootCAs: pool}))
+
+	for i := 0; i < 3; i++ {
+		exchange(t, c, s1.URL+DefaultPath, uint16(i+1))
+		exchange(t, c, s2.URL+DefaultPath, uint16(i+1))
+	}
+	if len(c.clis) != 2 {
+		t.Errorf("http clients %d,expect 2", len(c.clis))
+	}
+	cli := c.httpClient(s1.Listener.Addr().String())
+	if cli != c.httpClient(s1.Listener.Addr().String()) {
+		t.Errorf("http client of host is not reused")
+	}
+	if n1, n2 := atomic.LoadInt32(&s1.conns), atomic.LoadInt32(&s2.conns); n1 != 1 || n2 != 1 {
+		t.Errorf("connections %d %d,expect 1 1", n1, n2)
+	}
+}
+
+func TestClient_ExchangeHTTP3(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	// reuse the certificate of httptest
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	ts.Close()
+
+	s := &http3.Server{
+		Handler:   NewHandler(answerA),
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: ts.TLS.Certificates}),
+	}
+	go s.Serve(pc)
+	defer s.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	c := NewClient(WithTimeout(time.Second*2), WithHTTP3(true), WithTLSConfig(&tls.Config{RootCAs: pool}))
+
+	address := "https://" + pc.LocalAddr().String() + DefaultPath
+	for i := 0; i < 3; i++ {
+		exchange(t, c, address, uint16(i+1))
+	}
+}
@@ -0,0 +1,153 @@
+package doh
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const DefaultPath = "/dns-query"
+
+// Handler serves RFC8484 DoH requests(GET and POST) with a dns.Handler.
+type Handler struct {
+	dnsHandler dns.Handler
+}
+
+func NewHandler(h dns.Handler) *Handler {
+	return &Handler{dnsHandler: h}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		buf []byte
+		err error
+	)
+
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query().Get("dns")
+		if q == "" {
+			http.Error(w, "missing dns query parameter", http.StatusBadRequest)
+			return
+		}
+		// padding is not allowed by RFC8484, but some clients send it
+		buf, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(q, "="))
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != DoHMediaType {
+			http.Error(w, "unsupported content type "+ct, http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err = req.Unpack(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Question) != 1 {
+		http.Error(w, "only one question is supported", http.StatusBadRequest)
+		return
+	}
+
+	rw := &responseWriter{
+		w:      w,
+		local:  localAddr(r),
+		remote: remoteAddr(r),
+	}
+	h.dnsHandler.ServeDNS(rw, req)
+	if !rw.written {
+		http.Error(w, "no reply", http.StatusInternalServerError)
+	}
+}
+
+// responseWriter implements dns.ResponseWriter over a http response.
+type responseWriter struct {
+	w       http.ResponseWriter
+	local   net.Addr
+	remote  net.Addr
+	written bool
+}
+
+func (rw *responseWriter) LocalAddr() net.Addr {
+	return rw.local
+}
+
+func (rw *responseWriter) RemoteAddr() net.Addr {
+	return rw.remote
+}
+
+func (rw *responseWriter) WriteMsg(m *dns.Msg) error {
+	buf, err := m.Pack()
+	if err != nil {
+		return err
+	}
+
+	// https://www.rfc-editor.org/rfc/rfc8484#section-5.1
+	rw.w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(m)))
+	_, err = rw.Write(buf)
+	return err
+}
+
+func (rw *responseWriter) Write(buf []byte) (int, error) {
+	rw.written = true
+	rw.w.Header().Set("Content-Type", DoHMediaType)
+	return rw.w.Write(buf)
+}
+
+func (rw *responseWriter) Close() error {
+	return nil
+}
+
+func (rw *responseWriter) TsigStatus() error {
+	return nil
+}
+
+func (rw *responseWriter) TsigTimersOnly(bool) {
+}
+
+func (rw *responseWriter) Hijack() {
+}
+
+func minTTL(m *dns.Msg) uint32 {
+	var ttl uint32
+	first := true
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range rrs {
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	return ttl
+}
+
+func localAddr(r *http.Request) net.Addr {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+func remoteAddr(r *http.Request) net.Addr {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
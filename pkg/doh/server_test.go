@@ -0,0 +1,110 @@
+package doh
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func packQuery(t *testing.T) []byte {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.Id = 0
+	buf, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestHandler_ServeHTTP(t *testing.T) {
+	// answers with records of ttl 300 and 60, the max-age should be 60
+	h := NewHandler(dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		a1, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 1.2.3.4")
+		a2, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 5.6.7.8")
+		reply.Answer = append(reply.Answer, a1, a2)
+		_ = w.WriteMsg(reply)
+	}))
+
+	query := packQuery(t)
+	b64 := base64.RawURLEncoding.EncodeToString(query)
+
+	newPost := func(contentType string, body []byte) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, DefaultPath, bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		return r
+	}
+
+	tbls := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"get", httptest.NewRequest(http.MethodGet, DefaultPath+"?dns="+b64, nil), http.StatusOK},
+		{"get padding", httptest.NewRequest(http.MethodGet, DefaultPath+"?dns="+base64.URLEncoding.EncodeToString(query), nil), http.StatusOK},
+		{"post", newPost(DoHMediaType, query), http.StatusOK},
+		{"get without dns", httptest.NewRequest(http.MethodGet, DefaultPath, nil), http.StatusBadRequest},
+		{"get bad base64", httptest.NewRequest(http.MethodGet, DefaultPath+"?dns=!!!", nil), http.StatusBadRequest},
+		{"post wrong content type", newPost("application/json", query), http.StatusUnsupportedMediaType},
+		{"post malformed", newPost(DoHMediaType, []byte{1, 2, 3}), http.StatusBadRequest},
+		{"put", httptest.NewRequest(http.MethodPut, DefaultPath, bytes.NewReader(query)), http.StatusMethodNotAllowed},
+	}
+	for _, v := range tbls {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, v.req)
+		if w.Code != v.status {
+			t.Errorf("%s status:%d expect:%d %s", v.name, w.Code, v.status, strings.TrimSpace(w.Body.String()))
+			continue
+		}
+		if v.status != http.StatusOK {
+			continue
+		}
+
+		if ct := w.Header().Get("Content-Type"); ct != DoHMediaType {
+			t.Errorf("%s content type:%s", v.name, ct)
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != "max-age=60" {
+			t.Errorf("%s cache control:%s expect max-age=60", v.name, cc)
+		}
+		reply := new(dns.Msg)
+		if err := reply.Unpack(w.Body.Bytes()); err != nil {
+			t.Errorf("%s unpack reply:%v", v.name, err)
+			continue
+		}
+		if reply.Id != 0 || len(reply.Answer) != 2 {
+			t.Errorf("%s unexpected reply %v", v.name, reply)
+		}
+	}
+}
+
+func TestHandler_ServeHTTPNoReply(t *testing.T) {
+	h := NewHandler(dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, DefaultPath+"?dns="+base64.RawURLEncoding.EncodeToString(packQuery(t)), nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status:%d expect:%d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func Test_minTTL(t *testing.T) {
+	m := new(dns.Msg)
+	if ttl := minTTL(m); ttl != 0 {
+		t.Errorf("empty reply ttl:%d", ttl)
+	}
+
+	soa, _ := dns.NewRR("example.com. 30 IN SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 300")
+	a, _ := dns.NewRR("www.example.com. 120 IN A 1.2.3.4")
+	m.Answer = []dns.RR{a}
+	m.Ns = []dns.RR{soa}
+	if ttl := minTTL(m); ttl != 30 {
+		t.Errorf("ttl:%d expect:30", ttl)
+	}
+}
@@ -0,0 +1,308 @@
+package doq
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/0990/chinadns/pkg/util"
+	"github.com/0990/socks5"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// NextProtoDQ is the ALPN token of DNS-over-QUIC, https://www.rfc-editor.org/rfc/rfc9250#section-4.1.1
+const NextProtoDQ = "doq"
+
+const (
+	defaultTimeout        = 5 * time.Second
+	defaultKeepAlive      = 20 * time.Second
+	defaultMaxIdleTimeout = 60 * time.Second
+)
+
+var ErrQueryMyself = errors.New("not allowed to query myself")
+
+type clientOptions struct {
+	Timeout         time.Duration
+	SkipQueryMyself bool
+	Socks5Proxy     string
+	TLSConfig       *tls.Config
+}
+
+type ClientOption func(*clientOptions)
+
+// WithTimeout set a DNS query timeout
+func WithTimeout(t time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.Timeout = t
+	}
+}
+
+// WithSocks5Proxy sends QUIC packets through the UDP ASSOCIATE of a socks5 proxy
+func WithSocks5Proxy(proxy string) ClientOption {
+	return func(o *clientOptions) {
+		o.Socks5Proxy = proxy
+	}
+}
+
+// WithSkipQueryMySelf controls whether sending DNS request of DoQ server's domain to itself.
+// See doh.WithSkipQueryMySelf.
+func WithSkipQueryMySelf(skip bool) ClientOption {
+	return func(o *clientOptions) {
+		o.SkipQueryMyself = skip
+	}
+}
+
+// WithTLSConfig set the base tls config, ServerName and NextProtos are always overwritten
+func WithTLSConfig(cfg *tls.Config) ClientOption {
+	return func(o *clientOptions) {
+		o.TLSConfig = cfg
+	}
+}
+
+// Client is a DNS-over-QUIC (RFC 9250) client.
+// One QUIC connection is kept alive per resolver, every query is sent on its own stream.
+type Client struct {
+	opt *clientOptions
+	sc  *socks5.Socks5Client
+
+	sessions tls.ClientSessionCache
+
+	sync.Mutex
+	conns map[string]*conn
+}
+
+type conn struct {
+	sync.Mutex
+	qc quic.Connection
+}
+
+func NewClient(opts ...ClientOption) *Client {
+	o := &clientOptions{
+		Timeout: defaultTimeout,
+	}
+	for _, f := range opts {
+		f(o)
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = defaultTimeout
+	}
+
+	c := &Client{
+		opt:      o,
+		sessions: tls.NewLRUClientSessionCache(64),
+		conns:    make(map[string]*conn),
+	}
+
+	if o.Socks5Proxy != "" {
+		c.sc = socks5.NewSocks5Client(socks5.ClientCfg{
+			ServerAddr: o.Socks5Proxy,
+			UserName:   "",
+			Password:   "",
+			UDPTimout:  60,
+			TCPTimeout: 60,
+		})
+	}
+	return c
+}
+
+// Exchange sends req to the DoQ server at address(host:port). serverName overrides the TLS server name,
+// the host of address is used when it is empty.
+func (c *Client) Exchange(ctx context.Context, req *dns.Msg, address string, serverName string) (r *dns.Msg, rtt time.Duration, err error) {
+	begin := time.Now()
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	if serverName == "" {
+		serverName = host
+	}
+
+	if c.opt.SkipQueryMyself && net.ParseIP(serverName) == nil {
+		if req.Question[0].Name == dns.Fqdn(serverName) {
+			return nil, 0, ErrQueryMyself
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.opt.Timeout)
+	defer cancel()
+
+	cn := c.getConn(address + "#" + serverName)
+
+	qc, reused, err := cn.get(ctx, func(ctx context.Context) (quic.Connection, error) {
+		return c.dial(ctx, address, serverName)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r, err = c.exchange(ctx, qc, req)
+	if err != nil && reused && ctx.Err() == nil {
+		// the kept connection may be closed by the server silently, retry with a new one
+		cn.drop(qc)
+		qc, _, err = cn.get(ctx, func(ctx context.Context) (quic.Connection, error) {
+			return c.dial(ctx, address, serverName)
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		r, err = c.exchange(ctx, qc, req)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return r, time.Since(begin), nil
+}
+
+func (c *Client) exchange(ctx context.Context, qc quic.Connection, req *dns.Msg) (*dns.Msg, error) {
+	origID := req.Id
+
+	// The DNS Message ID MUST be set to 0, https://www.rfc-editor.org/rfc/rfc9250#section-4.2.1
+	req.Id = 0
+	buf, err := req.Pack()
+	req.Id = origID
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := qc.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+
+	if err = writeMsg(stream, buf); err != nil {
+		stream.CancelRead(0)
+		return nil, err
+	}
+	// client MUST send the STREAM FIN after the query
+	_ = stream.Close()
+
+	content, err := readMsg(stream)
+	if err != nil {
+		stream.CancelRead(0)
+		return nil, err
+	}
+
+	r := new(dns.Msg)
+	if err = r.Unpack(content); err != nil {
+		return nil, err
+	}
+	r.Id = origID
+	return r, nil
+}
+
+func (c *Client) dial(ctx context.Context, address, serverName string) (quic.Connection, error) {
+	var tlsConf *tls.Config
+	if c.opt.TLSConfig != nil {
+		tlsConf = c.opt.TLSConfig.Clone()
+	} else {
+		tlsConf = &tls.Config{}
+	}
+	tlsConf.ServerName = serverName
+	tlsConf.NextProtos = []string{NextProtoDQ}
+	tlsConf.MinVersion = tls.VersionTLS13
+	if tlsConf.ClientSessionCache == nil {
+		tlsConf.ClientSessionCache = c.sessions
+	}
+
+	quicConf := &quic.Config{
+		KeepAlivePeriod: defaultKeepAlive,
+		MaxIdleTimeout:  defaultMaxIdleTimeout,
+	}
+
+	if c.sc == nil {
+		return quic.DialAddr(ctx, address, tlsConf, quicConf)
+	}
+
+	uc, err := c.sc.DialTimeout("udp", address, c.opt.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := util.NewPacketConn(uc)
+	qc, err := quic.Dial(ctx, pc, pc.RemoteAddr(), tlsConf, quicConf)
+	if err != nil {
+		uc.Close()
+		return nil, err
+	}
+	go func() {
+		<-qc.Context().Done()
+		uc.Close()
+	}()
+	return qc, nil
+}
+
+func (c *Client) getConn(key string) *conn {
+	c.Lock()
+	defer c.Unlock()
+
+	cn, ok := c.conns[key]
+	if !ok {
+		cn = &conn{}
+		c.conns[key] = cn
+	}
+	return cn
+}
+
+// get returns the kept connection if it's still alive, otherwise dials a new one.
+func (cn *conn) get(ctx context.Context, dial func(ctx context.Context) (quic.Connection, error)) (qc quic.Connection, reused bool, err error) {
+	cn.Lock()
+	defer cn.Unlock()
+
+	if cn.qc != nil && cn.qc.Context().Err() == nil {
+		return cn.qc, true, nil
+	}
+
+	qc, err = dial(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	cn.qc = qc
+	return qc, false, nil
+}
+
+func (cn *conn) drop(qc quic.Connection) {
+	cn.Lock()
+	defer cn.Unlock()
+
+	if cn.qc == qc {
+		cn.qc = nil
+	}
+	_ = qc.CloseWithError(0, "")
+}
+
+func writeMsg(w io.Writer, buf []byte) error {
+	b := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(b, uint16(len(buf)))
+	copy(b[2:], buf)
+	_, err := w.Write(b)
+	return err
+}
+
+func readMsg(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint16(l[:])
+	if n < 12 {
+		return nil, fmt.Errorf("doq: message too short: %d", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,203 @@
+package doq
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// testServer is a minimal in-process DoQ server answering every A query with 1.2.3.4
+type testServer struct {
+	ln    *quic.Listener
+	conns int32
+}
+
+func newTestServer(t *testing.T, cert tls.Certificate) *testServer {
+	ln, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{NextProtoDQ},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{ln: ln}
+	go s.serve()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *testServer) serve() {
+	for {
+		qc, err := s.ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&s.conns, 1)
+		go func() {
+			for {
+				stream, err := qc.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				go s.handle(stream)
+			}
+		}()
+	}
+}
+
+func (s *testServer) handle(stream quic.Stream) {
+	defer stream.Close()
+
+	buf, err := readMsg(stream)
+	if err != nil {
+		return
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil || req.Id != 0 {
+		return
+	}
+
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 1.2.3.4")
+	reply.Answer = append(reply.Answer, rr)
+
+	out, err := reply.Pack()
+	if err != nil {
+		return
+	}
+	_ = writeMsg(stream, out)
+}
+
+func (s *testServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "doq.test"},
+		DNSNames:     []string{"doq.test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func TestClient_Exchange(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	s := newTestServer(t, cert)
+
+	c := NewClient(WithTimeout(time.Second*2), WithTLSConfig(&tls.Config{RootCAs: pool}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			req.Id = uint16(i + 1)
+
+			r, _, err := c.Exchange(context.Background(), req, s.addr(), "doq.test")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if r.Id != req.Id {
+				t.Errorf("reply id %d,expect %d", r.Id, req.Id)
+			}
+			if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+				t.Errorf("unexpected reply %v", r)
+			}
+		}(i)
+		// let the first query establish the connection
+		if i == 0 {
+			wg.Wait()
+		}
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&s.conns); n != 1 {
+		t.Errorf("quic connections %d,expect 1", n)
+	}
+}
+
+func TestClient_ExchangeBadServerName(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	s := newTestServer(t, cert)
+
+	c := NewClient(WithTimeout(time.Second), WithTLSConfig(&tls.Config{RootCAs: pool}))
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, _, err := c.Exchange(context.Background(), req, s.addr(), "other.test"); err == nil {
+		t.Fatal("expect tls verify error")
+	}
+}
+
+func TestServer_Serve(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	s := &Server{
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			reply := new(dns.Msg)
+			reply.SetReply(req)
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 5.6.7.8")
+			reply.Answer = append(reply.Answer, rr)
+			_ = w.WriteMsg(reply)
+		}),
+	}
+	go s.Serve(pc)
+	defer s.Shutdown()
+
+	c := NewClient(WithTimeout(time.Second*2), WithTLSConfig(&tls.Config{RootCAs: pool}))
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	r, _, err := c.Exchange(context.Background(), req, pc.LocalAddr().String(), "doq.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != req.Id || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "5.6.7.8" {
+		t.Errorf("unexpected reply %v", r)
+	}
+}
@@ -0,0 +1,180 @@
+package doq
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/sirupsen/logrus"
+)
+
+// error codes, https://www.rfc-editor.org/rfc/rfc9250#section-8.4
+const (
+	ErrCodeNoError       = 0x0
+	ErrCodeInternalError = 0x1
+	ErrCodeProtocolError = 0x2
+)
+
+// Server is a DNS-over-QUIC (RFC 9250) server, every query stream is served by Handler.
+type Server struct {
+	Addr      string
+	TLSConfig *tls.Config
+	Handler   dns.Handler
+
+	mu sync.Mutex
+	ln *quic.Listener
+}
+
+// ListenAndServe listens on the UDP address s.Addr and serves DoQ.
+func (s *Server) ListenAndServe() error {
+	pc, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	return s.Serve(pc)
+}
+
+// Serve serves DoQ on pc, it blocks until Shutdown is called or the listener fails.
+func (s *Server) Serve(pc net.PacketConn) error {
+	if s.TLSConfig == nil {
+		return errors.New("doq: tls config is required")
+	}
+
+	tlsConf := s.TLSConfig.Clone()
+	tlsConf.NextProtos = []string{NextProtoDQ}
+
+	ln, err := quic.Listen(pc, tlsConf, &quic.Config{
+		MaxIdleTimeout:        defaultMaxIdleTimeout,
+		MaxIncomingStreams:    256,
+		MaxIncomingUniStreams: -1,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+
+	for {
+		qc, err := ln.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(qc)
+	}
+}
+
+// Shutdown closes the listener and all accepted connections.
+func (s *Server) Shutdown() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Close()
+}
+
+func (s *Server) serveConn(qc quic.Connection) {
+	for {
+		stream, err := qc.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go s.serveStream(qc, stream)
+	}
+}
+
+func (s *Server) serveStream(qc quic.Connection, stream quic.Stream) {
+	_ = stream.SetReadDeadline(time.Now().Add(defaultTimeout))
+
+	buf, err := readMsg(stream)
+	if err != nil {
+		stream.CancelRead(ErrCodeProtocolError)
+		stream.CancelWrite(ErrCodeProtocolError)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err = req.Unpack(buf); err != nil || len(req.Question) != 1 {
+		stream.CancelRead(ErrCodeProtocolError)
+		stream.CancelWrite(ErrCodeProtocolError)
+		return
+	}
+
+	// A server that receives a message ID other than 0 MUST treat it as a connection error
+	if req.Id != 0 {
+		_ = qc.CloseWithError(ErrCodeProtocolError, "message id is not 0")
+		return
+	}
+
+	rw := &responseWriter{qc: qc, stream: stream}
+	s.Handler.ServeDNS(rw, req)
+	if !rw.written {
+		stream.CancelWrite(ErrCodeInternalError)
+	}
+}
+
+// responseWriter implements dns.ResponseWriter over a QUIC stream.
+type responseWriter struct {
+	qc      quic.Connection
+	stream  quic.Stream
+	written bool
+}
+
+func (rw *responseWriter) LocalAddr() net.Addr {
+	return rw.qc.LocalAddr()
+}
+
+func (rw *responseWriter) RemoteAddr() net.Addr {
+	return rw.qc.RemoteAddr()
+}
+
+func (rw *responseWriter) WriteMsg(m *dns.Msg) error {
+	m.Id = 0
+	buf, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = rw.Write(buf)
+	return err
+}
+
+func (rw *responseWriter) Write(buf []byte) (int, error) {
+	if rw.written {
+		return 0, errors.New("doq: reply has been written")
+	}
+	rw.written = true
+
+	_ = rw.stream.SetWriteDeadline(time.Now().Add(defaultTimeout))
+	if err := writeMsg(rw.stream, buf); err != nil {
+		logrus.WithError(err).Debug("doq write reply")
+		return 0, err
+	}
+	// server MUST send the STREAM FIN after the reply
+	return len(buf), rw.stream.Close()
+}
+
+func (rw *responseWriter) Close() error {
+	return rw.stream.Close()
+}
+
+func (rw *responseWriter) TsigStatus() error {
+	return nil
+}
+
+func (rw *responseWriter) TsigTimersOnly(bool) {
+}
+
+func (rw *responseWriter) Hijack() {
+}
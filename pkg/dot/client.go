@@ -0,0 +1,263 @@
+package dot
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/0990/socks5"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultTimeout     = 5 * time.Second
+	defaultIdleTimeout = 30 * time.Second
+	defaultMaxIdle     = 4
+)
+
+var ErrQueryMyself = errors.New("not allowed to query myself")
+
+type clientOptions struct {
+	Timeout         time.Duration
+	IdleTimeout     time.Duration
+	MaxIdleConns    int
+	SkipQueryMyself bool
+	Socks5Proxy     string
+	TLSConfig       *tls.Config
+}
+
+type ClientOption func(*clientOptions)
+
+// WithTimeout set a DNS query timeout
+func WithTimeout(t time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.Timeout = t
+	}
+}
+
+// WithIdleTimeout set how long an idle TLS connection is kept for reuse
+func WithIdleTimeout(t time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.IdleTimeout = t
+	}
+}
+
+// WithMaxIdleConns set the max idle connections kept per resolver
+func WithMaxIdleConns(n int) ClientOption {
+	return func(o *clientOptions) {
+		o.MaxIdleConns = n
+	}
+}
+
+func WithSocks5Proxy(proxy string) ClientOption {
+	return func(o *clientOptions) {
+		o.Socks5Proxy = proxy
+	}
+}
+
+// WithSkipQueryMySelf controls whether sending DNS request of DoT server's domain to itself.
+// See doh.WithSkipQueryMySelf.
+func WithSkipQueryMySelf(skip bool) ClientOption {
+	return func(o *clientOptions) {
+		o.SkipQueryMyself = skip
+	}
+}
+
+// WithTLSConfig set the base tls config, ServerName is always overwritten
+func WithTLSConfig(cfg *tls.Config) ClientOption {
+	return func(o *clientOptions) {
+		o.TLSConfig = cfg
+	}
+}
+
+type idleConn struct {
+	conn *dns.Conn
+	used time.Time
+}
+
+// Client is a DNS-over-TLS (RFC 7858) client, TLS connections are kept and reused across queries.
+type Client struct {
+	opt  *clientOptions
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	sessions tls.ClientSessionCache
+
+	sync.Mutex
+	idle map[string][]idleConn
+}
+
+func NewClient(opts ...ClientOption) *Client {
+	o := &clientOptions{
+		Timeout:      defaultTimeout,
+		IdleTimeout:  defaultIdleTimeout,
+		MaxIdleConns: defaultMaxIdle,
+	}
+	for _, f := range opts {
+		f(o)
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = defaultTimeout
+	}
+
+	var d net.Dialer
+	dial := d.DialContext
+	if o.Socks5Proxy != "" {
+		sc := socks5.NewSocks5Client(socks5.ClientCfg{
+			ServerAddr: o.Socks5Proxy,
+			UserName:   "",
+			Password:   "",
+			UDPTimout:  60,
+			TCPTimeout: 60,
+		})
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return sc.DialTimeout(network, addr, timeoutOf(ctx, o.Timeout))
+		}
+	}
+
+	return &Client{
+		opt:      o,
+		dial:     dial,
+		sessions: tls.NewLRUClientSessionCache(64),
+		idle:     make(map[string][]idleConn),
+	}
+}
+
+// Exchange sends req to the DoT server at address(host:port). serverName overrides the TLS server name,
+// the host of address is used when it is empty.
+func (c *Client) Exchange(ctx context.Context, req *dns.Msg, address string, serverName string) (r *dns.Msg, rtt time.Duration, err error) {
+	begin := time.Now()
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	if serverName == "" {
+		serverName = host
+	}
+
+	if c.opt.SkipQueryMyself && net.ParseIP(serverName) == nil {
+		if req.Question[0].Name == dns.Fqdn(serverName) {
+			return nil, 0, ErrQueryMyself
+		}
+	}
+
+	key := address + "#" + serverName
+
+	// a reused connection may have been closed by the server, retry once with a fresh one
+	if co := c.getIdle(key); co != nil {
+		r, err = c.exchange(ctx, co, req)
+		if err == nil {
+			c.putIdle(key, co)
+			return r, time.Since(begin), nil
+		}
+		co.Close()
+		if ctx.Err() != nil {
+			return nil, 0, err
+		}
+	}
+
+	co, err := c.dialTLS(ctx, address, serverName)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r, err = c.exchange(ctx, co, req)
+	if err != nil {
+		co.Close()
+		return nil, 0, err
+	}
+	c.putIdle(key, co)
+	return r, time.Since(begin), nil
+}
+
+func (c *Client) exchange(ctx context.Context, co *dns.Conn, req *dns.Msg) (*dns.Msg, error) {
+	if err := co.SetDeadline(time.Now().Add(timeoutOf(ctx, c.opt.Timeout))); err != nil {
+		return nil, err
+	}
+
+	if err := co.WriteMsg(req); err != nil {
+		return nil, err
+	}
+
+	for {
+		r, err := co.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+		// skip late replies of former timeout queries on this connection
+		if r.Id == req.Id {
+			return r, nil
+		}
+	}
+}
+
+func (c *Client) dialTLS(ctx context.Context, address, serverName string) (*dns.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeoutOf(ctx, c.opt.Timeout))
+	defer cancel()
+
+	raw, err := c.dial(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	var tlsConf *tls.Config
+	if c.opt.TLSConfig != nil {
+		tlsConf = c.opt.TLSConfig.Clone()
+	} else {
+		tlsConf = &tls.Config{}
+	}
+	tlsConf.ServerName = serverName
+	if tlsConf.MinVersion < tls.VersionTLS12 {
+		tlsConf.MinVersion = tls.VersionTLS12
+	}
+	if tlsConf.ClientSessionCache == nil {
+		tlsConf.ClientSessionCache = c.sessions
+	}
+
+	conn := tls.Client(raw, tlsConf)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, err
+	}
+
+	return &dns.Conn{Conn: conn}, nil
+}
+
+func (c *Client) getIdle(key string) *dns.Conn {
+	c.Lock()
+	defer c.Unlock()
+
+	conns := c.idle[key]
+	for len(conns) > 0 {
+		ic := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if time.Since(ic.used) < c.opt.IdleTimeout {
+			c.idle[key] = conns
+			return ic.conn
+		}
+		ic.conn.Close()
+	}
+	delete(c.idle, key)
+	return nil
+}
+
+func (c *Client) putIdle(key string, co *dns.Conn) {
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.idle[key]) >= c.opt.MaxIdleConns {
+		co.Close()
+		return
+	}
+	c.idle[key] = append(c.idle[key], idleConn{conn: co, used: time.Now()})
+}
+
+func timeoutOf(ctx context.Context, def time.Duration) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok && !deadline.IsZero() {
+		return time.Until(deadline)
+	}
+	return def
+}
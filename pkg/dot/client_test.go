@@ -0,0 +1,217 @@
+package dot
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testServer is a minimal in-process DoT server answering every A query with 1.2.3.4.
+// Queries of stale.example.com are answered with a wrong id first, like a late reply of a former query.
+type testServer struct {
+	ln net.Listener
+
+	sync.Mutex
+	conns []net.Conn
+}
+
+func newTestServer(t *testing.T, cert tls.Certificate) *testServer {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{ln: ln}
+	go s.serve()
+	t.Cleanup(func() {
+		ln.Close()
+		s.closeConns()
+	})
+	return s
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.Lock()
+		s.conns = append(s.conns, conn)
+		s.Unlock()
+		go s.handle(&dns.Conn{Conn: conn})
+	}
+}
+
+func (s *testServer) handle(co *dns.Conn) {
+	defer co.Close()
+	for {
+		req, err := co.ReadMsg()
+		if err != nil {
+			return
+		}
+
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 1.2.3.4")
+		reply.Answer = append(reply.Answer, rr)
+
+		if req.Question[0].Name == "stale.example.com." {
+			late := reply.Copy()
+			late.Id = req.Id + 1
+			late.Answer = nil
+			if err := co.WriteMsg(late); err != nil {
+				return
+			}
+		}
+		if err := co.WriteMsg(reply); err != nil {
+			return
+		}
+	}
+}
+
+// accepted returns the number of connections accepted
+func (s *testServer) accepted() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.conns)
+}
+
+// closeConns closes the accepted connections, like a server closing idle ones
+func (s *testServer) closeConns() {
+	s.Lock()
+	defer s.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *testServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dot.test"},
+		DNSNames:     []string{"dot.test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func exchange(t *testing.T, c *Client, addr, serverName, name string, id uint16) {
+	t.Helper()
+
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	req.Id = id
+
+	r, _, err := c.Exchange(context.Background(), req, addr, serverName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != req.Id {
+		t.Errorf("reply id %d,expect %d", r.Id, req.Id)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+		t.Errorf("unexpected reply %v", r)
+	}
+}
+
+func TestClient_Exchange(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	s := newTestServer(t, cert)
+
+	c := NewClient(WithTimeout(time.Second*2), WithTLSConfig(&tls.Config{RootCAs: pool}))
+	for i := 0; i < 5; i++ {
+		exchange(t, c, s.addr(), "dot.test", "example.com.", uint16(i+1))
+	}
+	if n := s.accepted(); n != 1 {
+		t.Errorf("tls connections %d,expect 1", n)
+	}
+
+	// the late reply with another id is skipped
+	exchange(t, c, s.addr(), "dot.test", "stale.example.com.", 100)
+	exchange(t, c, s.addr(), "dot.test", "example.com.", 101)
+	if n := s.accepted(); n != 1 {
+		t.Errorf("tls connections %d,expect 1", n)
+	}
+
+	// connections of another server name are pooled separately
+	exchange(t, c, s.addr(), "127.0.0.1", "example.com.", 102)
+	if n := s.accepted(); n != 2 {
+		t.Errorf("tls connections %d,expect 2", n)
+	}
+}
+
+func TestClient_ExchangeRetryClosedIdle(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	s := newTestServer(t, cert)
+
+	c := NewClient(WithTimeout(time.Second*2), WithTLSConfig(&tls.Config{RootCAs: pool}))
+	exchange(t, c, s.addr(), "dot.test", "example.com.", 1)
+
+	s.closeConns()
+	// wait for the close_notify and FIN to reach the idle connection
+	time.Sleep(time.Millisecond * 50)
+
+	exchange(t, c, s.addr(), "dot.test", "example.com.", 2)
+	if n := s.accepted(); n != 2 {
+		t.Errorf("tls connections %d,expect 2", n)
+	}
+}
+
+func TestClient_ExchangeIdleTimeout(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	s := newTestServer(t, cert)
+
+	c := NewClient(WithTimeout(time.Second*2), WithTLSConfig(&tls.Config{RootCAs: pool}), WithIdleTimeout(time.Millisecond*10))
+	exchange(t, c, s.addr(), "dot.test", "example.com.", 1)
+	time.Sleep(time.Millisecond * 20)
+	exchange(t, c, s.addr(), "dot.test", "example.com.", 2)
+	if n := s.accepted(); n != 2 {
+		t.Errorf("tls connections %d,expect 2", n)
+	}
+}
+
+func TestClient_ExchangeBadServerName(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	s := newTestServer(t, cert)
+
+	c := NewClient(WithTimeout(time.Second), WithTLSConfig(&tls.Config{RootCAs: pool}))
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, _, err := c.Exchange(context.Background(), req, s.addr(), "other.test"); err == nil {
+		t.Fatal("expect tls verify error")
+	}
+}
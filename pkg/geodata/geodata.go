@@ -0,0 +1,238 @@
+// Package geodata reads geosite.dat and geoip.dat of v2ray/xray, which are protobuf encoded lists:
+// https://github.com/v2fly/v2ray-core/blob/master/app/router/routercommon/common.proto
+package geodata
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// DomainType is the match type of a domain in geosite
+type DomainType int
+
+const (
+	DomainPlain  DomainType = 0 // keyword, the value is a substring of domain
+	DomainRegex  DomainType = 1 // regular expression
+	DomainDomain DomainType = 2 // the domain and its subdomains
+	DomainFull   DomainType = 3 // the exact domain
+)
+
+type Domain struct {
+	Type  DomainType
+	Value string
+	Attrs []string // attributes without value, like ads of @ads
+}
+
+func (d *Domain) HasAttr(attr string) bool {
+	for _, v := range d.Attrs {
+		if strings.EqualFold(v, attr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRef parses code@attr1@attr2 into country code and attributes
+func ParseRef(ref string) (code string, attrs []string) {
+	parts := strings.Split(ref, "@")
+	code = parts[0]
+	for _, v := range parts[1:] {
+		if v != "" {
+			attrs = append(attrs, v)
+		}
+	}
+	return code, attrs
+}
+
+// LoadGeoSite returns domains of code in the geosite file, only domains having all the attrs are returned.
+func LoadGeoSite(file, code string, attrs ...string) ([]Domain, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := findEntry(data, code)
+	if err != nil {
+		return nil, fmt.Errorf("geosite %s in %s:%w", code, file, err)
+	}
+
+	var domains []Domain
+	err = rangeFields(entry, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		// GeoSite.domain
+		if num != 2 || typ != protowire.BytesType {
+			return nil
+		}
+		d, err := parseDomain(v)
+		if err != nil {
+			return err
+		}
+		for _, attr := range attrs {
+			if !d.HasAttr(attr) {
+				return nil
+			}
+		}
+		domains = append(domains, d)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("geosite %s in %s:%w", code, file, err)
+	}
+	return domains, nil
+}
+
+// LoadGeoIP returns networks of code in the geoip file
+func LoadGeoIP(file, code string) ([]*net.IPNet, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := findEntry(data, code)
+	if err != nil {
+		return nil, fmt.Errorf("geoip %s in %s:%w", code, file, err)
+	}
+
+	var networks []*net.IPNet
+	err = rangeFields(entry, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		// GeoIP.cidr
+		if num != 2 || typ != protowire.BytesType {
+			return nil
+		}
+		network, err := parseCIDR(v)
+		if err != nil {
+			return err
+		}
+		networks = append(networks, network)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("geoip %s in %s:%w", code, file, err)
+	}
+	return networks, nil
+}
+
+// findEntry returns the GeoSite or GeoIP entry whose country_code is code, both of them are field 1 of the list,
+// and country_code is field 1 of the entry.
+func findEntry(data []byte, code string) ([]byte, error) {
+	var found []byte
+	errStop := errors.New("stop")
+	err := rangeFields(data, func(num protowire.Number, typ protowire.Type, entry []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		// only country_code is read, which is usually the first field
+		err := rangeFields(entry, func(num protowire.Number, typ protowire.Type, v []byte) error {
+			if num != 1 || typ != protowire.BytesType {
+				return nil
+			}
+			if strings.EqualFold(string(v), code) {
+				found = entry
+			}
+			return errStop
+		})
+		if found != nil {
+			return errStop
+		}
+		if err != nil && err != errStop {
+			return err
+		}
+		return nil
+	})
+	if found != nil {
+		return found, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, errors.New("not found")
+}
+
+func parseDomain(data []byte) (Domain, error) {
+	var d Domain
+	err := rangeFields(data, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			n, _ := protowire.ConsumeVarint(v)
+			d.Type = DomainType(n)
+		case num == 2 && typ == protowire.BytesType:
+			d.Value = string(v)
+		case num == 3 && typ == protowire.BytesType:
+			// Attribute.key
+			return rangeFields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				if num == 1 && typ == protowire.BytesType {
+					d.Attrs = append(d.Attrs, string(v))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return d, err
+}
+
+func parseCIDR(data []byte) (*net.IPNet, error) {
+	var (
+		ip     net.IP
+		prefix int
+	)
+	err := rangeFields(data, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			ip = net.IP(v)
+		case num == 2 && typ == protowire.VarintType:
+			n, _ := protowire.ConsumeVarint(v)
+			prefix = int(n)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return nil, fmt.Errorf("invalid ip length %d", len(ip))
+	}
+	mask := net.CIDRMask(prefix, len(ip)*8)
+	if mask == nil {
+		return nil, fmt.Errorf("invalid prefix %d", prefix)
+	}
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+// rangeFields calls f with every field of the message, v is the raw varint for VarintType,
+// and the content for BytesType.
+func rangeFields(data []byte, f func(num protowire.Number, typ protowire.Type, v []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		var v []byte
+		switch typ {
+		case protowire.BytesType:
+			b, m := protowire.ConsumeBytes(data)
+			if m < 0 {
+				return protowire.ParseError(m)
+			}
+			v, n = b, m
+		default:
+			m := protowire.ConsumeFieldValue(num, typ, data)
+			if m < 0 {
+				return protowire.ParseError(m)
+			}
+			v, n = data[:m], m
+		}
+		data = data[n:]
+
+		if err := f(num, typ, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package geodata
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func appendBytesField(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendVarintField(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func encodeDomain(typ DomainType, value string, attrs ...string) []byte {
+	var b []byte
+	b = appendVarintField(b, 1, uint64(typ))
+	b = appendBytesField(b, 2, []byte(value))
+	for _, attr := range attrs {
+		var a []byte
+		a = appendBytesField(a, 1, []byte(attr))
+		a = appendVarintField(a, 2, 1)
+		b = appendBytesField(b, 3, a)
+	}
+	return b
+}
+
+func encodeCIDR(s string) []byte {
+	_, network, _ := net.ParseCIDR(s)
+	ip := network.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	ones, _ := network.Mask.Size()
+
+	var b []byte
+	b = appendBytesField(b, 1, ip)
+	return appendVarintField(b, 2, uint64(ones))
+}
+
+func writeList(t *testing.T, entries map[string][][]byte) string {
+	var list []byte
+	for code, fields := range entries {
+		var entry []byte
+		entry = appendBytesField(entry, 1, []byte(code))
+		for _, v := range fields {
+			entry = appendBytesField(entry, 2, v)
+		}
+		list = appendBytesField(list, 1, entry)
+	}
+
+	file := filepath.Join(t.TempDir(), "geo.dat")
+	if err := os.WriteFile(file, list, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadGeoSite(t *testing.T) {
+	file := writeList(t, map[string][][]byte{
+		"CN": {
+			encodeDomain(DomainDomain, "baidu.com"),
+			encodeDomain(DomainFull, "www.qq.com"),
+			encodeDomain(DomainDomain, "ad.cn", "ads"),
+		},
+		"GOOGLE": {
+			encodeDomain(DomainPlain, "google"),
+			encodeDomain(DomainRegex, `^gg\.[a-z]+$`),
+		},
+	})
+
+	domains, err := LoadGeoSite(file, "cn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 3 || domains[1].Type != DomainFull || domains[1].Value != "www.qq.com" {
+		t.Errorf("domains %+v", domains)
+	}
+
+	code, attrs := ParseRef("cn@ads")
+	domains, err = LoadGeoSite(file, code, attrs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 1 || domains[0].Value != "ad.cn" {
+		t.Errorf("domains with attr %+v", domains)
+	}
+
+	if _, err = LoadGeoSite(file, "us"); err == nil {
+		t.Errorf("expect not found")
+	}
+}
+
+func TestLoadGeoIP(t *testing.T) {
+	file := writeList(t, map[string][][]byte{
+		"CN": {encodeCIDR("1.0.1.0/24"), encodeCIDR("2400:3200::/32")},
+		"US": {encodeCIDR("8.8.8.0/24")},
+	})
+
+	networks, err := LoadGeoIP(file, "cn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 2 || networks[0].String() != "1.0.1.0/24" || networks[1].String() != "2400:3200::/32" {
+		t.Errorf("networks %v", networks)
+	}
+}
@@ -0,0 +1,61 @@
+package geodata
+
+import (
+	"net"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// IsMMDB reports whether the file is a MaxMind DB by its extension
+func IsMMDB(file string) bool {
+	return strings.HasSuffix(strings.ToLower(file), ".mmdb")
+}
+
+// mmdbCountry is the country record of GeoLite2-Country and ip-location-db like databases
+type mmdbCountry struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	CountryCode string `maxminddb:"country_code"`
+}
+
+func (c *mmdbCountry) code() string {
+	if c.Country.ISOCode != "" {
+		return c.Country.ISOCode
+	}
+	return c.CountryCode
+}
+
+// LoadMMDB returns networks located in any of the countries in the mmdb file, countries are ISO 3166 codes like CN.
+func LoadMMDB(file string, countries []string) ([]*net.IPNet, error) {
+	db, err := maxminddb.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	want := make(map[string]bool)
+	for _, v := range countries {
+		want[strings.ToUpper(v)] = true
+	}
+
+	var networks []*net.IPNet
+	it := db.Networks(maxminddb.SkipAliasedNetworks)
+	for it.Next() {
+		var record mmdbCountry
+		network, err := it.Network(&record)
+		if err != nil {
+			return nil, err
+		}
+		if want[strings.ToUpper(record.code())] {
+			// ip of network may be shared by the iterator
+			network.IP = append(net.IP(nil), network.IP...)
+			networks = append(networks, network)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return networks, nil
+}
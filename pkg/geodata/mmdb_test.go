@@ -0,0 +1,121 @@
+package geodata
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// writeMMDB writes an IPv6 MaxMind DB of the records, IPv4 networks are aliased at ::ffff:0:0/96 etc. like databases of MaxMind
+func writeMMDB(t *testing.T, records map[string]mmdbtype.Map) string {
+	tree, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: "Test-Country", RecordSize: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cidr, record := range records {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.Insert(network, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file := filepath.Join(t.TempDir(), "country.mmdb")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := tree.WriteTo(f); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadMMDB(t *testing.T) {
+	geoLite := func(code string) mmdbtype.Map {
+		return mmdbtype.Map{"country": mmdbtype.Map{"iso_code": mmdbtype.String(code)}}
+	}
+	// ip-location-db style
+	flat := func(code string) mmdbtype.Map {
+		return mmdbtype.Map{"country_code": mmdbtype.String(code)}
+	}
+	file := writeMMDB(t, map[string]mmdbtype.Map{
+		"1.0.1.0/24":     geoLite("CN"),
+		"1.0.2.0/23":     flat("cn"),
+		"8.8.8.0/24":     geoLite("US"),
+		"2400:da00::/32": geoLite("CN"),
+		"2001:4860::/32": flat("US"),
+	})
+
+	// the fixture has the aliases which LoadMMDB should skip
+	db, err := maxminddb.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var aliased int
+	for it := db.Networks(); it.Next(); {
+		aliased++
+	}
+	db.Close()
+	if aliased <= 5 {
+		t.Fatalf("fixture has %d networks,expect aliases of the IPv4 ones", aliased)
+	}
+
+	tbls := []struct {
+		countries []string
+		networks  []string
+	}{
+		{[]string{"CN"}, []string{"1.0.1.0/24", "1.0.2.0/23", "2400:da00::/32"}},
+		{[]string{"us", "JP"}, []string{"8.8.8.0/24", "2001:4860::/32"}},
+		{[]string{"JP"}, nil},
+	}
+	for _, v := range tbls {
+		networks, err := LoadMMDB(file, v.countries)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// aliases of the IPv4 networks are skipped
+		got := make(map[string]bool)
+		for _, network := range networks {
+			got[network.String()] = true
+			if network.IP.To4() != nil && len(network.IP) != net.IPv4len {
+				t.Errorf("%v ipv4 network %s is not in 4 bytes", v.countries, network)
+			}
+		}
+		if len(networks) != len(v.networks) || len(got) != len(networks) {
+			t.Errorf("%v networks:%v expect:%v", v.countries, networks, v.networks)
+			continue
+		}
+		for _, network := range v.networks {
+			if !got[network] {
+				t.Errorf("%v networks:%v missing %s", v.countries, networks, network)
+			}
+		}
+	}
+
+	if _, err := LoadMMDB(filepath.Join(t.TempDir(), "none.mmdb"), []string{"CN"}); err == nil {
+		t.Errorf("expect error of missing file")
+	}
+}
+
+func TestIsMMDB(t *testing.T) {
+	for file, want := range map[string]bool{
+		"GeoLite2-Country.mmdb": true,
+		"country.MMDB":          true,
+		"geoip.dat":             false,
+		"china_ip_list.txt":     false,
+	} {
+		if IsMMDB(file) != want {
+			t.Errorf("IsMMDB(%s) expect %v", file, want)
+		}
+	}
+}
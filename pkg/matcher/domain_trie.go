@@ -4,20 +4,39 @@ import "strings"
 
 type domainTrie struct {
 	children map[string]*domainTrie
-	end      bool
+	end      bool // matches the domain and its subdomains
+	full     bool // matches the exact domain only
 }
 
 func (tr *domainTrie) Add(domain string) {
+	node := tr.add(domain)
+	if node == nil {
+		return
+	}
+	node.end = true
+	// "." matches all domains
+	if node == tr {
+		tr.children = nil
+	}
+}
+
+// AddFull adds a domain which doesn't match its subdomains
+func (tr *domainTrie) AddFull(domain string) {
+	if node := tr.add(domain); node != nil {
+		node.full = true
+	}
+}
+
+// add returns the node of domain, nil if the domain is already covered by a parent one
+func (tr *domainTrie) add(domain string) *domainTrie {
 	domain = strings.TrimSpace(domain)
 	if domain == "" {
-		return
+		return nil
 	}
 
 	domain = strings.Trim(domain, ".")
 	if domain == "" {
-		tr.end = true
-		tr.children = nil
-		return
+		return tr
 	}
 
 	node := tr
@@ -26,7 +45,7 @@ func (tr *domainTrie) Add(domain string) {
 
 	for i := len(labels) - 1; i >= 0; i-- {
 		if node.end {
-			return
+			return nil
 		}
 
 		if node.children == nil {
@@ -38,33 +57,40 @@ func (tr *domainTrie) Add(domain string) {
 		}
 		node = node.children[label]
 	}
-	node.end = true
+	return node
 }
 
 func (tr *domainTrie) Contain(domain string) bool {
+	_, _, ok := tr.Match(domain)
+	return ok
+}
+
+// Match returns the matched domain in trie and whether it's a full one,
+// the matched domain is empty if "." is added.
+func (tr *domainTrie) Match(domain string) (string, bool, bool) {
 	if tr == nil {
-		return false
+		return "", false, false
+	}
+	if tr.end {
+		return "", false, true
 	}
 
 	domain = strings.Trim(domain, ".")
-	labels := strings.Split(domain, ".")
-
 	node := tr
-	if node.end {
-		return true
-	}
-
-	for i := len(labels) - 1; i >= 0; i-- {
-		label := labels[i]
-		node = node.children[label]
+	// rest is the part of domain not walked yet, from the last label
+	rest := domain
+	for {
+		i := strings.LastIndexByte(rest, '.')
+		node = node.children[rest[i+1:]]
 		if node == nil {
-			return false
+			return "", false, false
 		}
-
 		if node.end {
-			return true
+			return domain[i+1:], false, true
+		}
+		if i < 0 {
+			return domain, true, node.full
 		}
+		rest = rest[:i]
 	}
-
-	return false
 }
@@ -0,0 +1,45 @@
+package matcher
+
+import (
+	"strings"
+
+	"github.com/0990/chinadns/pkg/geodata"
+)
+
+// GeoSitePrefix is the prefix of rule path referencing a list in geosite.dat, like geosite:cn or geosite:google@ads
+const GeoSitePrefix = "geosite:"
+
+func IsGeoSite(path string) bool {
+	return strings.HasPrefix(path, GeoSitePrefix)
+}
+
+// NewGeoSiteMatcher creates a matcher from the list of geosite file,
+// ref is geosite:code with optional @attr, and only domains having all the attrs are used.
+func NewGeoSiteMatcher(file, ref string) (*RuleMatcher, error) {
+	code, attrs := geodata.ParseRef(strings.TrimPrefix(ref, GeoSitePrefix))
+	domains, err := geodata.LoadGeoSite(file, code, attrs...)
+	if err != nil {
+		return nil, err
+	}
+
+	m := NewRuleMatcher()
+	for _, d := range domains {
+		var typ RuleType
+		switch d.Type {
+		case geodata.DomainPlain:
+			typ = RuleKeyword
+		case geodata.DomainRegex:
+			typ = RuleRegexp
+		case geodata.DomainDomain:
+			typ = RuleDomain
+		case geodata.DomainFull:
+			typ = RuleFull
+		default:
+			continue
+		}
+		if err := m.AddRule(Rule{Type: typ, Value: d.Value, File: ref}); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
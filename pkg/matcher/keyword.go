@@ -0,0 +1,103 @@
+package matcher
+
+// keywordMatcher is an Aho-Corasick automaton, which finds whether a domain contains any of the keywords
+// in a single pass, no matter how many keywords there are.
+type keywordMatcher struct {
+	nodes []acNode
+}
+
+type acNode struct {
+	next map[byte]int32
+	fail int32
+	out  int32 // index+1 of the keyword ending here or at a node of its fail chain, 0 if none
+}
+
+func newKeywordMatcher(keywords []string) *keywordMatcher {
+	m := &keywordMatcher{nodes: []acNode{{}}}
+	for i, v := range keywords {
+		m.add(v, int32(i+1))
+	}
+	m.build()
+	return m
+}
+
+func (m *keywordMatcher) add(keyword string, out int32) {
+	var cur int32
+	for i := 0; i < len(keyword); i++ {
+		c := keyword[i]
+		next, ok := m.nodes[cur].next[c]
+		if !ok {
+			if m.nodes[cur].next == nil {
+				m.nodes[cur].next = make(map[byte]int32)
+			}
+			m.nodes = append(m.nodes, acNode{})
+			next = int32(len(m.nodes) - 1)
+			m.nodes[cur].next[c] = next
+		}
+		cur = next
+	}
+	if m.nodes[cur].out == 0 {
+		m.nodes[cur].out = out
+	}
+}
+
+// build sets the fail links by bfs
+func (m *keywordMatcher) build() {
+	queue := make([]int32, 0, len(m.nodes))
+	for _, child := range m.nodes[0].next {
+		queue = append(queue, child)
+	}
+
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+
+		for c, child := range m.nodes[cur].next {
+			fail := m.nodes[cur].fail
+			for fail > 0 {
+				if _, ok := m.nodes[fail].next[c]; ok {
+					break
+				}
+				fail = m.nodes[fail].fail
+			}
+			if next, ok := m.nodes[fail].next[c]; ok && next != child {
+				m.nodes[child].fail = next
+			}
+			if m.nodes[child].out == 0 {
+				m.nodes[child].out = m.nodes[m.nodes[child].fail].out
+			}
+			queue = append(queue, child)
+		}
+	}
+}
+
+func (m *keywordMatcher) IsMatch(domain string) bool {
+	_, ok := m.Match(domain)
+	return ok
+}
+
+// Match returns the index of a keyword contained in domain
+func (m *keywordMatcher) Match(domain string) (int, bool) {
+	if m.nodes[0].out > 0 {
+		return int(m.nodes[0].out - 1), true
+	}
+
+	var cur int32
+	for i := 0; i < len(domain); i++ {
+		c := domain[i]
+		for {
+			if next, ok := m.nodes[cur].next[c]; ok {
+				cur = next
+				break
+			}
+			if cur == 0 {
+				break
+			}
+			cur = m.nodes[cur].fail
+		}
+		if out := m.nodes[cur].out; out > 0 {
+			return int(out - 1), true
+		}
+	}
+	return 0, false
+}
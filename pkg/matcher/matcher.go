@@ -2,10 +2,32 @@ package matcher
 
 import (
 	"errors"
+	"strings"
 )
 
 type Matcher interface {
 	IsMatch(domain string) bool
+	// Len returns the count of rules
+	Len() int
+}
+
+// UpstreamMatcher is implemented by matchers whose rules carry an upstream dns,
+// like server=/domain/114.114.114.114 of dnsmasq.
+type UpstreamMatcher interface {
+	Upstream(domain string) (string, bool)
+}
+
+// ExplainMatcher is implemented by matchers which can tell the rule matching a domain.
+type ExplainMatcher interface {
+	Match(domain string) (Rule, bool)
+}
+
+// Explain returns the rule of m matching domain, the rule is zero if m can't tell it.
+func Explain(m Matcher, domain string) (Rule, bool) {
+	if em, ok := m.(ExplainMatcher); ok {
+		return em.Match(domain)
+	}
+	return Rule{}, m.IsMatch(domain)
 }
 
 type CombineMatcher struct {
@@ -21,6 +43,34 @@ func (p *CombineMatcher) IsMatch(domain string) bool {
 	return false
 }
 
+func (p *CombineMatcher) Match(domain string) (Rule, bool) {
+	for _, v := range p.matchers {
+		if r, ok := Explain(v, domain); ok {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+func (p *CombineMatcher) Len() int {
+	var n int
+	for _, v := range p.matchers {
+		n += v.Len()
+	}
+	return n
+}
+
+func (p *CombineMatcher) Upstream(domain string) (string, bool) {
+	for _, v := range p.matchers {
+		if um, ok := v.(UpstreamMatcher); ok {
+			if upstream, ok := um.Upstream(domain); ok {
+				return upstream, true
+			}
+		}
+	}
+	return "", false
+}
+
 func NewCombineMatcher(ms ...Matcher) Matcher {
 	return &CombineMatcher{
 		matchers: ms,
@@ -46,9 +96,30 @@ func new(typ string, file string) (Matcher, error) {
 		return NewSimpleMatcherFromFile(file)
 	case "domaintrie":
 		return NewDomainTrieMatcherFromFile(file)
+	case "rule":
+		return NewRuleMatcherFromFile(file)
 	case "debug":
 		return NewDebugMatcher(file)
 	default:
 		return nil, errors.New("not support matcher type")
 	}
 }
+
+// lookupUpstream looks up domain and its parents in upstreams, from the longest one
+func lookupUpstream(upstreams map[string]string, domain string) (string, bool) {
+	if len(upstreams) == 0 {
+		return "", false
+	}
+
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	for {
+		if upstream, ok := upstreams[domain]; ok {
+			return upstream, true
+		}
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			return "", false
+		}
+		domain = domain[i+1:]
+	}
+}
@@ -39,3 +39,7 @@ func (p *DebugMatcher) IsMatch(domain string) bool {
 	}
 	return b
 }
+
+func (p *DebugMatcher) Len() int {
+	return p.DomainTrieMatcher.Len()
+}
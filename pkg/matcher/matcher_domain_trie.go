@@ -1,34 +1,44 @@
 package matcher
 
-import (
-	"bufio"
-	"os"
-)
-
 type DomainTrieMatcher struct {
-	tr *domainTrie
+	tr     *domainTrie
+	except *domainTrie
+	n      int
+
+	upstreams map[string]string
 }
 
 func NewDomainTrieMatcherFromFile(file string) (*DomainTrieMatcher, error) {
-	f, err := os.Open(file)
+	rf, err := readRuleFile(file)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
-	tr := &domainTrie{}
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		tr.Add(scanner.Text())
+	m := &DomainTrieMatcher{tr: &domainTrie{}}
+	for _, v := range rf.domains {
+		m.tr.Add(v)
 	}
-
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	if len(rf.exceptions) > 0 {
+		m.except = &domainTrie{}
+		for _, v := range rf.exceptions {
+			m.except.Add(v)
+		}
 	}
+	m.n = len(rf.domains)
+	m.upstreams = rf.upstreams
 
-	return &DomainTrieMatcher{tr: tr}, nil
+	return m, nil
+}
+
+func (m *DomainTrieMatcher) Len() int {
+	return m.n
 }
 
 func (m *DomainTrieMatcher) IsMatch(domain string) bool {
-	return m.tr.Contain(domain)
+	return m.tr.Contain(domain) && !m.except.Contain(domain)
+}
+
+// Upstream returns the upstream of the longest matched domain
+func (m *DomainTrieMatcher) Upstream(domain string) (string, bool) {
+	return lookupUpstream(m.upstreams, domain)
 }
@@ -0,0 +1,247 @@
+package matcher
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// RuleType is the way a rule matches domains
+type RuleType int
+
+const (
+	RuleDomain  RuleType = iota // the domain and its subdomains
+	RuleFull                    // the exact domain
+	RuleKeyword                 // domains containing the value
+	RuleRegexp                  // domains matching the regular expression
+)
+
+func (t RuleType) String() string {
+	for k, v := range rulePrefixes {
+		if v == t {
+			return k
+		}
+	}
+	return fmt.Sprintf("RuleType(%d)", int(t))
+}
+
+func (t RuleType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// Rule is a domain rule and where it comes from, File and Line are empty if unknown
+type Rule struct {
+	Type  RuleType `json:"type"`
+	Value string   `json:"value"`
+	File  string   `json:"file,omitempty"`
+	Line  int      `json:"line,omitempty"`
+}
+
+// String formats the rule like full:www.qq.com(chn.txt:3)
+func (r Rule) String() string {
+	s := r.Type.String() + ":" + r.Value
+	switch {
+	case r.File != "" && r.Line > 0:
+		s += fmt.Sprintf("(%s:%d)", r.File, r.Line)
+	case r.File != "":
+		s += "(" + r.File + ")"
+	}
+	return s
+}
+
+type ruleKey struct {
+	typ   RuleType
+	value string
+}
+
+// rulePrefixes are the prefixes of rules in list files, the same as the domain list of v2ray
+var rulePrefixes = map[string]RuleType{
+	"domain":  RuleDomain,
+	"full":    RuleFull,
+	"keyword": RuleKeyword,
+	"regexp":  RuleRegexp,
+}
+
+// RuleMatcher matches domains by rules of different types, like the domain list of v2ray.
+// Domain and full rules are in a trie, keywords are matched by an Aho-Corasick automaton,
+// so the cost of matching them hardly grows with the count of rules.
+// Regexps are tried one by one, which is faster than an alternation of them in go,
+// as each regexp keeps its own literal prefix optimization.
+type RuleMatcher struct {
+	domains  *domainTrie
+	except   *domainTrie
+	keywords []string
+	regexps  []*regexp.Regexp
+	n        int
+
+	upstreams map[string]string
+	sources   map[ruleKey]Rule // source of rules added by AddRule
+
+	// automaton of keywords, built on the first match after keywords changed
+	mu        sync.Mutex
+	keywordAC atomic.Pointer[keywordMatcher]
+}
+
+func NewRuleMatcher() *RuleMatcher {
+	return &RuleMatcher{
+		domains: &domainTrie{},
+	}
+}
+
+// NewRuleMatcherFromFile creates a matcher from list file, whose lines can be prefixed by
+// full:, domain:, keyword: or regexp:, and lines without prefix are domain rules.
+func NewRuleMatcherFromFile(file string) (*RuleMatcher, error) {
+	rf, err := readRuleFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	m := NewRuleMatcher()
+	for _, v := range rf.rules {
+		if err := m.AddRule(v); err != nil {
+			return nil, fmt.Errorf("%s:%d:%w", v.File, v.Line, err)
+		}
+	}
+	if len(rf.exceptions) > 0 {
+		m.except = &domainTrie{}
+		for _, v := range rf.exceptions {
+			m.except.Add(v)
+		}
+	}
+	m.upstreams = rf.upstreams
+	return m, nil
+}
+
+// Add adds a rule, it should not be called concurrently with IsMatch
+func (m *RuleMatcher) Add(typ RuleType, value string) error {
+	return m.AddRule(Rule{Type: typ, Value: value})
+}
+
+// AddRule adds a rule and records its source for Match, it should not be called concurrently with IsMatch
+func (m *RuleMatcher) AddRule(r Rule) error {
+	typ, value := r.Type, r.Value
+	key := ruleKey{typ: typ, value: value}
+	switch typ {
+	case RuleDomain:
+		key.value = strings.Trim(strings.ToLower(strings.TrimSpace(value)), ".")
+		m.domains.Add(strings.ToLower(value))
+	case RuleFull:
+		key.value = strings.Trim(strings.ToLower(strings.TrimSpace(value)), ".")
+		m.domains.AddFull(strings.ToLower(value))
+	case RuleKeyword:
+		key.value = strings.ToLower(value)
+		m.keywords = append(m.keywords, key.value)
+	case RuleRegexp:
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return fmt.Errorf("invalid regexp %s:%w", value, err)
+		}
+		m.regexps = append(m.regexps, re)
+	default:
+		return fmt.Errorf("unknown rule type %d", typ)
+	}
+	if typ == RuleKeyword {
+		m.keywordAC.Store(nil)
+	}
+	if r.File != "" {
+		if m.sources == nil {
+			m.sources = make(map[ruleKey]Rule)
+		}
+		// the first one wins for duplicated rules
+		if _, ok := m.sources[key]; !ok {
+			m.sources[key] = r
+		}
+	}
+	m.n++
+	return nil
+}
+
+func (m *RuleMatcher) Len() int {
+	return m.n
+}
+
+func (m *RuleMatcher) IsMatch(domain string) bool {
+	_, ok := m.Match(domain)
+	return ok
+}
+
+// Match returns the rule matching domain, domain and full rules are preferred to keywords and regexps.
+func (m *RuleMatcher) Match(domain string) (Rule, bool) {
+	domain = strings.ToLower(domain)
+	if m.except.Contain(domain) {
+		return Rule{}, false
+	}
+	if matched, full, ok := m.domains.Match(domain); ok {
+		typ := RuleDomain
+		if full {
+			typ = RuleFull
+		}
+		return m.source(typ, matched), true
+	}
+
+	if len(m.keywords) > 0 {
+		if i, ok := m.keywordMatcher().Match(domain); ok {
+			return m.source(RuleKeyword, m.keywords[i]), true
+		}
+	}
+	for _, re := range m.regexps {
+		if re.MatchString(domain) {
+			return m.source(RuleRegexp, re.String()), true
+		}
+	}
+	return Rule{}, false
+}
+
+func (m *RuleMatcher) source(typ RuleType, value string) Rule {
+	if r, ok := m.sources[ruleKey{typ: typ, value: value}]; ok {
+		return r
+	}
+	if value == "" && typ == RuleDomain {
+		value = "."
+	}
+	return Rule{Type: typ, Value: value}
+}
+
+// Upstream returns the upstream of the longest matched domain
+func (m *RuleMatcher) Upstream(domain string) (string, bool) {
+	return lookupUpstream(m.upstreams, domain)
+}
+
+func (m *RuleMatcher) keywordMatcher() *keywordMatcher {
+	if km := m.keywordAC.Load(); km != nil {
+		return km
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	km := m.keywordAC.Load()
+	if km == nil {
+		km = newKeywordMatcher(m.keywords)
+		m.keywordAC.Store(km)
+	}
+	return km
+}
+
+// parseRule parses line like full:www.google.com, the value is followed by optional attrs like @ads, which are ignored
+func parseRule(line string) (RuleType, string, bool) {
+	prefix, value, ok := strings.Cut(line, ":")
+	if !ok {
+		return 0, "", false
+	}
+	typ, ok := rulePrefixes[strings.ToLower(prefix)]
+	if !ok {
+		return 0, "", false
+	}
+
+	value = strings.TrimSpace(value)
+	if typ != RuleRegexp {
+		if fields := strings.Fields(value); len(fields) > 0 {
+			value = fields[0]
+		}
+	} else if i := strings.Index(value, " @"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return typ, value, true
+}
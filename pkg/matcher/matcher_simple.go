@@ -1,48 +1,40 @@
 package matcher
 
 import (
-	"bufio"
-	"os"
 	"strings"
 )
 
 type SimpleMatcher struct {
-	domains []string
+	domains    []string
+	exceptions []string
 }
 
 func NewSimpleMatcherFromFile(file string) (*SimpleMatcher, error) {
-	f, err := os.Open(file)
+	rf, err := readRuleFile(file)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
 	dm := &SimpleMatcher{}
-
-	reader := bufio.NewReader(f)
-	for {
-		var line []byte
-		data, isPrefix, err := reader.ReadLine()
-		if nil != err {
-			break
-		}
-		line = append(line, data...)
-		if isPrefix {
-			continue
-		}
-		dm.addRule(string(line))
+	for _, v := range rf.domains {
+		dm.domains = append(dm.domains, strings.TrimSpace(v))
+	}
+	for _, v := range rf.exceptions {
+		dm.exceptions = append(dm.exceptions, strings.TrimSpace(v))
 	}
 	return dm, nil
 }
 
-func (p *SimpleMatcher) addRule(rule string) {
-	rule = strings.TrimSpace(rule)
-
-	p.domains = append(p.domains, rule)
+func (p *SimpleMatcher) Len() int {
+	return len(p.domains)
 }
 
 func (p *SimpleMatcher) IsMatch(domain string) bool {
-	for _, dr := range p.domains {
+	return matchSuffix(p.domains, domain) && !matchSuffix(p.exceptions, domain)
+}
+
+func matchSuffix(rules []string, domain string) bool {
+	for _, dr := range rules {
 		if strings.HasSuffix(domain, dr) {
 			if domain == dr || strings.HasSuffix(domain, "."+dr) {
 				return true
@@ -2,7 +2,10 @@ package matcher
 
 import (
 	"bufio"
+	"encoding/base64"
+	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -92,3 +95,289 @@ func Test_Matcher_Compare(t *testing.T) {
 
 	m.IsMatch("access.open.uc.cn")
 }
+
+func TestGfwList(t *testing.T) {
+	list := `[AutoProxy 0.2.9]
+! Checksum: xxx
+! comment
+||google.com
+|http://www.example.org/path
+|https://*.twitter.com
+.facebook.com
+youtube.com/watch
+/^https?:\/\/[^\/]+blogspot\.(.*)/
+||1.2.3.4
+@@||cn.google.com
+@@|http://www.facebook.com
+`
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"plain.txt":  list,
+		"base64.txt": base64.StdEncoding.EncodeToString([]byte(list)),
+	} {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, typ := range []string{"simple", "domaintrie", "rule"} {
+			m, err := New(typ, file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Len() != 5 {
+				t.Errorf("%s %s Len %d,expect 5", name, typ, m.Len())
+			}
+
+			tbls := []struct {
+				domain  string
+				isMatch bool
+			}{
+				{"www.google.com", true},
+				{"cn.google.com", false},
+				{"a.cn.google.com", false},
+				{"www.example.org", true},
+				{"example.org", false},
+				{"api.twitter.com", true},
+				{"facebook.com", true},
+				{"www.facebook.com", false},
+				{"youtube.com", true},
+				{"blogspot.com", false},
+				{"1.2.3.4", false},
+			}
+			for _, v := range tbls {
+				if ret := m.IsMatch(v.domain); ret != v.isMatch {
+					t.Errorf("%s %s domain:%s ret:%v expect:%v", name, typ, v.domain, ret, v.isMatch)
+				}
+			}
+		}
+	}
+}
+
+func TestDnsmasq(t *testing.T) {
+	conf := `# dnsmasq-china-list
+server=/baidu.com/114.114.114.114
+server=/qq.com/weixin.qq.com/223.5.5.5#5353
+server=/local/
+ipset=/taobao.com/tmall.com/chnroute
+plain.cn
+`
+	file := filepath.Join(t.TempDir(), "accelerated-domains.china.conf")
+	if err := os.WriteFile(file, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := New("domaintrie", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != 7 {
+		t.Errorf("Len %d,expect 7", m.Len())
+	}
+	for _, domain := range []string{"www.baidu.com", "qq.com", "a.local", "www.tmall.com", "plain.cn"} {
+		if !m.IsMatch(domain) {
+			t.Errorf("%s not match", domain)
+		}
+	}
+
+	tbls := []struct {
+		domain   string
+		upstream string
+	}{
+		{"www.baidu.com", "114.114.114.114"},
+		{"weixin.qq.com", "223.5.5.5:5353"},
+		{"a.local", ""},
+		{"taobao.com", ""},
+		{"plain.cn", ""},
+	}
+	um := m.(UpstreamMatcher)
+	for _, v := range tbls {
+		upstream, _ := um.Upstream(v.domain)
+		if upstream != v.upstream {
+			t.Errorf("domain:%s upstream:%s expect:%s", v.domain, upstream, v.upstream)
+		}
+	}
+}
+
+func TestRuleMatcher(t *testing.T) {
+	m := NewRuleMatcher()
+	rules := []struct {
+		typ   RuleType
+		value string
+	}{
+		{RuleDomain, "google.com"},
+		{RuleFull, "www.qq.com"},
+		{RuleKeyword, "facebook"},
+		{RuleRegexp, `^ad[0-9]+\.example\.org$`},
+	}
+	for _, v := range rules {
+		if err := m.Add(v.typ, v.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Add(RuleRegexp, "("); err == nil {
+		t.Errorf("expect invalid regexp")
+	}
+
+	tbls := []struct {
+		domain  string
+		isMatch bool
+	}{
+		{"www.Google.com", true},
+		{"www.qq.com", true},
+		{"qq.com", false},
+		{"a.www.qq.com", false},
+		{"facebook.net", true},
+		{"ad12.example.org", true},
+		{"ad.example.org", false},
+	}
+	for _, v := range tbls {
+		if ret := m.IsMatch(v.domain); ret != v.isMatch {
+			t.Errorf("domain:%s ret:%v expect:%v", v.domain, ret, v.isMatch)
+		}
+	}
+}
+
+func TestRuleMatcherFromFile(t *testing.T) {
+	list := `# v2ray like rules
+google.com
+domain:twitter.com
+full:www.qq.com @cn
+keyword:facebook
+regexp:^ad[0-9]+\.example\.org$
+regexp:^(?i)cdn\.
+`
+	file := filepath.Join(t.TempDir(), "rules.txt")
+	if err := os.WriteFile(file, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := New("rule", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != 6 {
+		t.Errorf("Len %d,expect 6", m.Len())
+	}
+
+	tbls := []struct {
+		domain  string
+		isMatch bool
+	}{
+		{"www.google.com", true},
+		{"api.twitter.com", true},
+		{"www.qq.com", true},
+		{"qq.com", false},
+		{"a.www.qq.com", false},
+		{"m.facebook.net", true},
+		{"ad12.example.org", true},
+		{"ad.example.org", false},
+		{"cdn.example.com", true},
+		{"www.cdn.example.com", false},
+	}
+	for _, v := range tbls {
+		if ret := m.IsMatch(v.domain); ret != v.isMatch {
+			t.Errorf("domain:%s ret:%v expect:%v", v.domain, ret, v.isMatch)
+		}
+	}
+
+	explains := []struct {
+		domain string
+		rule   Rule
+	}{
+		{"www.google.com", Rule{Type: RuleDomain, Value: "google.com", File: file, Line: 2}},
+		{"api.twitter.com", Rule{Type: RuleDomain, Value: "twitter.com", File: file, Line: 3}},
+		{"WWW.qq.com", Rule{Type: RuleFull, Value: "www.qq.com", File: file, Line: 4}},
+		{"m.facebook.net", Rule{Type: RuleKeyword, Value: "facebook", File: file, Line: 5}},
+		{"cdn.example.com", Rule{Type: RuleRegexp, Value: `^(?i)cdn\.`, File: file, Line: 7}},
+	}
+	for _, v := range explains {
+		rule, ok := Explain(m, v.domain)
+		if !ok || rule != v.rule {
+			t.Errorf("domain:%s rule:%v expect:%v", v.domain, rule, v.rule)
+		}
+	}
+	if rule := explains[2].rule.String(); rule != "full:www.qq.com("+file+":4)" {
+		t.Errorf("rule string %s", rule)
+	}
+	if _, ok := Explain(m, "qq.com"); ok {
+		t.Errorf("qq.com should not match")
+	}
+
+	// domain trie matcher only supports domain rules
+	dm, err := New("domaintrie", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dm.IsMatch("api.twitter.com") || dm.IsMatch("www.qq.com") {
+		t.Errorf("domain trie matcher with prefixed rules")
+	}
+
+	if err := os.WriteFile(file, []byte("regexp:("), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New("rule", file); err == nil {
+		t.Errorf("expect invalid regexp")
+	}
+}
+
+func TestKeywordMatcher(t *testing.T) {
+	m := newKeywordMatcher([]string{"he", "she", "his", "hers", "usher"})
+
+	tbls := []struct {
+		domain  string
+		isMatch bool
+	}{
+		{"ushers.com", true},
+		{"xhis.org", true},
+		{"shx.net", false},
+		{"hhhe", true},
+		{"ahishers", true},
+		{"h", false},
+		{"", false},
+	}
+	for _, v := range tbls {
+		if ret := m.IsMatch(v.domain); ret != v.isMatch {
+			t.Errorf("domain:%s ret:%v expect:%v", v.domain, ret, v.isMatch)
+		}
+	}
+}
+
+var benchDomains = []string{"www.google.com", "baidu.com", "a.b.c.d.example.org", "api.twitter.com", "www.qq.com"}
+
+func benchmarkMatcher(b *testing.B, typ string) {
+	m, err := New(typ, "gfwlist.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.IsMatch(benchDomains[i%len(benchDomains)])
+	}
+}
+
+func BenchmarkDomainTrieMatcher(b *testing.B) {
+	benchmarkMatcher(b, "domaintrie")
+}
+
+func BenchmarkRuleMatcher(b *testing.B) {
+	benchmarkMatcher(b, "rule")
+}
+
+// BenchmarkRuleMatcherMixed matches against the domain rules of gfwlist.txt plus keyword and regexp rules
+func BenchmarkRuleMatcherMixed(b *testing.B) {
+	m, err := NewRuleMatcherFromFile("gfwlist.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		m.Add(RuleKeyword, fmt.Sprintf("keyword%d", i))
+		m.Add(RuleRegexp, fmt.Sprintf(`^ad%d[0-9]*\.example\.com$`, i))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.IsMatch(benchDomains[i%len(benchDomains)])
+	}
+}
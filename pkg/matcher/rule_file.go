@@ -0,0 +1,209 @@
+package matcher
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"net"
+	"os"
+	"strings"
+)
+
+// ruleFile is the domains read from a rule file, whose format is detected by content:
+//   - plain list, one domain per line, which can be prefixed by full:, domain:, keyword: or regexp:
+//   - dnsmasq config, server=/domain/upstream or ipset=/domain/set lines, which can be mixed with plain list
+//   - gfwlist, in AutoProxy(Adblock Plus) format, base64 encoded or not
+type ruleFile struct {
+	file string
+	line int // line number being parsed
+
+	domains    []string
+	exceptions []string          // domains excluded from domains, by @@ rules of gfwlist
+	upstreams  map[string]string // upstream of domains, by server=/domain/upstream lines of dnsmasq
+	rules      []Rule            // all the rules with their source, including domains, only used by RuleMatcher
+}
+
+func readRuleFile(file string) (*ruleFile, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if decoded, ok := decodeGfwList(data); ok {
+		data = decoded
+	}
+
+	rf := &ruleFile{file: file}
+	parse := rf.addPlain
+	if isGfwList(data) {
+		parse = rf.addGfwList
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		rf.line++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		parse(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *ruleFile) addPlain(line string) {
+	if strings.HasPrefix(line, "#") {
+		return
+	}
+	if strings.HasPrefix(line, "server=/") || strings.HasPrefix(line, "ipset=/") || strings.HasPrefix(line, "nftset=/") {
+		rf.addDnsmasq(line)
+		return
+	}
+	if typ, value, ok := parseRule(line); ok {
+		if value == "" {
+			return
+		}
+		if typ == RuleDomain {
+			rf.addDomain(value)
+		} else {
+			rf.addRule(typ, value)
+		}
+		return
+	}
+	rf.addDomain(line)
+}
+
+func (rf *ruleFile) addDomain(domain string) {
+	rf.domains = append(rf.domains, domain)
+	rf.addRule(RuleDomain, domain)
+}
+
+func (rf *ruleFile) addRule(typ RuleType, value string) {
+	rf.rules = append(rf.rules, Rule{Type: typ, Value: value, File: rf.file, Line: rf.line})
+}
+
+// addDnsmasq adds domains of server=/domain1/domain2/upstream or ipset=/domain1/domain2/set line,
+// the upstream like 114.114.114.114#53 is recorded as 114.114.114.114:53
+func (rf *ruleFile) addDnsmasq(line string) {
+	key, value, _ := strings.Cut(line, "=")
+	fields := strings.Split(value, "/")
+	// fields[0] is empty, and the last one is upstream or set name
+	if len(fields) < 3 {
+		return
+	}
+	domains := fields[1 : len(fields)-1]
+
+	var upstream string
+	if key == "server" {
+		upstream = strings.TrimSpace(fields[len(fields)-1])
+		// server=/domain/# means the default upstream
+		if upstream == "#" {
+			upstream = ""
+		}
+		// upstream may be followed by the source address,like 1.1.1.1@eth0
+		upstream, _, _ = strings.Cut(upstream, "@")
+		if host, port, ok := strings.Cut(upstream, "#"); ok {
+			upstream = net.JoinHostPort(host, port)
+		}
+	}
+
+	for _, domain := range domains {
+		domain = strings.TrimSpace(domain)
+		if domain == "" {
+			continue
+		}
+		rf.addDomain(domain)
+		if upstream != "" {
+			if rf.upstreams == nil {
+				rf.upstreams = make(map[string]string)
+			}
+			rf.upstreams[strings.ToLower(strings.Trim(domain, "."))] = upstream
+		}
+	}
+}
+
+// addGfwList adds an AutoProxy rule, https://github.com/gfwlist/gfwlist/wiki/Syntax
+// Only the domain of rule is used, as dns has no idea of url.
+func (rf *ruleFile) addGfwList(line string) {
+	// comment and header
+	if strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		return
+	}
+
+	exception := strings.HasPrefix(line, "@@")
+	line = strings.TrimPrefix(line, "@@")
+
+	domain, ok := gfwListDomain(line)
+	if !ok {
+		return
+	}
+
+	if exception {
+		rf.exceptions = append(rf.exceptions, domain)
+	} else {
+		rf.addDomain(domain)
+	}
+}
+
+// gfwListDomain returns the domain of rule like ||domain, |http://domain/path, .domain, domain/path
+func gfwListDomain(rule string) (string, bool) {
+	// regexp rule
+	if strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/") {
+		return "", false
+	}
+
+	rule = strings.TrimPrefix(rule, "||")
+	rule = strings.TrimPrefix(rule, "|")
+	rule = strings.TrimPrefix(rule, "http://")
+	rule = strings.TrimPrefix(rule, "https://")
+
+	if i := strings.IndexAny(rule, "/%^|?:"); i >= 0 {
+		rule = rule[:i]
+	}
+
+	// *.example.com matches the same domains with .example.com
+	rule = strings.TrimPrefix(rule, "*")
+	rule = strings.Trim(rule, ".")
+	if rule == "" || strings.Contains(rule, "*") || !strings.Contains(rule, ".") {
+		return "", false
+	}
+	if net.ParseIP(rule) != nil {
+		return "", false
+	}
+	for _, c := range rule {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return "", false
+		}
+	}
+	return strings.ToLower(rule), true
+}
+
+func isGfwList(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("[AutoProxy"))
+}
+
+// decodeGfwList decodes the base64 encoded gfwlist, which is the format of the official one
+func decodeGfwList(data []byte) ([]byte, bool) {
+	data = bytes.Map(func(r rune) rune {
+		switch r {
+		case '\r', '\n', ' ', '\t':
+			return -1
+		}
+		return r
+	}, data)
+
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(decoded, data)
+	if err != nil {
+		return nil, false
+	}
+	decoded = decoded[:n]
+	if !isGfwList(decoded) {
+		return nil, false
+	}
+	return decoded, true
+}
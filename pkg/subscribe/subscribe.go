@@ -0,0 +1,351 @@
+// Package subscribe keeps remote rule files in sync with local copies, which are used as normal rule files.
+package subscribe
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/0990/socks5"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IsURL reports whether the rule path is a remote http(s) file
+func IsURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+type options struct {
+	Timeout     time.Duration
+	Socks5Proxy string
+}
+
+type Option func(*options)
+
+// WithTimeout set the timeout of a download
+func WithTimeout(t time.Duration) Option {
+	return func(o *options) {
+		o.Timeout = t
+	}
+}
+
+// WithSocks5Proxy downloads files via the socks5 proxy
+func WithSocks5Proxy(proxy string) Option {
+	return func(o *options) {
+		o.Socks5Proxy = proxy
+	}
+}
+
+// meta is the validators of a downloaded file, which are sent back in conditional requests
+type meta struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+type subscription struct {
+	url  string
+	file string
+
+	interval time.Duration // <=0 never refreshes
+	next     time.Time     // time of the next refresh, guarded by Manager
+}
+
+func (s *subscription) metaFile() string {
+	return s.file + ".meta"
+}
+
+// Manager downloads remote files into dir, and refreshes them periodically.
+type Manager struct {
+	opt options
+	dir string
+	cli *http.Client
+
+	sync.Mutex
+	subs map[string]*subscription // key is url
+}
+
+func New(dir string, opts ...Option) *Manager {
+	o := options{Timeout: 30 * time.Second}
+	for _, f := range opts {
+		f(&o)
+	}
+
+	t := &http.Transport{
+		Proxy:               nil,
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if o.Socks5Proxy != "" {
+		sc := socks5.NewSocks5Client(socks5.ClientCfg{
+			ServerAddr: o.Socks5Proxy,
+			UDPTimout:  60,
+			TCPTimeout: 60,
+		})
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return sc.DialTimeout(network, addr, o.Timeout)
+		}
+	}
+
+	return &Manager{
+		opt:  o,
+		dir:  dir,
+		cli:  &http.Client{Timeout: o.Timeout, Transport: t},
+		subs: make(map[string]*subscription),
+	}
+}
+
+// Add subscribes the url which is refreshed every interval by Run, and returns the local file of it.
+// The file is downloaded at once if it doesn't exist yet, otherwise the cached one is used until refreshed.
+// Adding a subscribed url again updates its interval.
+func (m *Manager) Add(rawURL string, interval time.Duration) (string, error) {
+	m.Lock()
+	sub, ok := m.subs[rawURL]
+	if ok && sub.interval != interval {
+		sub.interval = interval
+		sub.next = time.Now().Add(interval)
+	}
+	m.Unlock()
+	if ok {
+		return sub.file, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha1.Sum([]byte(rawURL))
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		name = u.Hostname()
+	}
+	sub = &subscription{
+		url:      rawURL,
+		file:     filepath.Join(m.dir, hex.EncodeToString(sum[:4])+"_"+name),
+		interval: interval,
+		// the cached file is checked at the first run
+		next: time.Now(),
+	}
+
+	if _, err := os.Stat(sub.file); err != nil {
+		if err := os.MkdirAll(m.dir, 0755); err != nil {
+			return "", err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), m.opt.Timeout)
+		defer cancel()
+		data, mt, err := m.download(ctx, sub, meta{})
+		if err != nil {
+			return "", fmt.Errorf("download %s:%w", rawURL, err)
+		}
+		if err := writeFile(sub.file, data); err != nil {
+			return "", err
+		}
+		saveMeta(sub, mt)
+		sub.next = time.Now().Add(interval)
+	}
+
+	m.Lock()
+	m.subs[rawURL] = sub
+	m.Unlock()
+	return sub.file, nil
+}
+
+// Refresh checks all the subscriptions at once, see refresh.
+func (m *Manager) Refresh(ctx context.Context, apply func() error) (bool, error) {
+	return m.refresh(ctx, m.subscriptions(false), apply)
+}
+
+// Run refreshes every subscription when its interval is due, subscriptions added later are included.
+func (m *Manager) Run(apply func() error) {
+	for {
+		if subs := m.subscriptions(true); len(subs) > 0 {
+			if _, err := m.refresh(context.Background(), subs, apply); err != nil {
+				logrus.WithError(err).Error("refresh rule subscriptions")
+			}
+		}
+		time.Sleep(checkInterval)
+	}
+}
+
+// checkInterval is how often Run looks for the due subscriptions
+const checkInterval = time.Minute
+
+// subscriptions returns the subscriptions, only the ones due for refresh if due is true.
+// The next refresh time of the returned ones is updated.
+func (m *Manager) subscriptions(due bool) []*subscription {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+	subs := make([]*subscription, 0, len(m.subs))
+	for _, sub := range m.subs {
+		if due && (sub.interval <= 0 || now.Before(sub.next)) {
+			continue
+		}
+		sub.next = now.Add(sub.interval)
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// refresh downloads the subscriptions which have changed, and calls apply to use them.
+// Each subscription is downloaded independently, a failed one is logged and keeps its file, the others are still updated.
+// Updated files are restored when apply fails, so that a broken remote file never replaces a working one.
+// It returns whether any file is updated.
+func (m *Manager) refresh(ctx context.Context, subs []*subscription, apply func() error) (bool, error) {
+	type update struct {
+		sub  *subscription
+		old  []byte
+		meta meta
+	}
+
+	var updates []update
+	for _, sub := range subs {
+		old, mt, err := m.update(ctx, sub)
+		if err != nil {
+			logrus.WithError(err).WithField("url", sub.url).Error("refresh rule subscription")
+			continue
+		}
+		if old != nil {
+			updates = append(updates, update{sub: sub, old: old, meta: mt})
+		}
+	}
+
+	if len(updates) == 0 {
+		return false, nil
+	}
+
+	if apply != nil {
+		if err := apply(); err != nil {
+			for _, u := range updates {
+				if err := writeFile(u.sub.file, u.old); err != nil {
+					logrus.WithError(err).WithField("file", u.sub.file).Error("restore rule file")
+				}
+			}
+			return false, err
+		}
+	}
+
+	for _, u := range updates {
+		saveMeta(u.sub, u.meta)
+		logrus.WithFields(logrus.Fields{
+			"url":  u.sub.url,
+			"file": u.sub.file,
+		}).Info("rule subscription updated")
+	}
+	return true, nil
+}
+
+// update downloads the subscription and replaces its file if modified, it returns the old content of the replaced file.
+func (m *Manager) update(ctx context.Context, sub *subscription) ([]byte, meta, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.opt.Timeout)
+	defer cancel()
+
+	data, mt, err := m.download(ctx, sub, loadMeta(sub))
+	if err != nil || data == nil {
+		return nil, mt, err
+	}
+
+	old, err := os.ReadFile(sub.file)
+	if err != nil {
+		return nil, mt, err
+	}
+	if err := writeFile(sub.file, data); err != nil {
+		return nil, mt, err
+	}
+	return old, mt, nil
+}
+
+func (m *Manager) Len() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.subs)
+}
+
+// download gets the file with conditional request, data is nil when it's not modified
+func (m *Manager) download(ctx context.Context, sub *subscription, mt meta) ([]byte, meta, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sub.url, nil)
+	if err != nil {
+		return nil, meta{}, err
+	}
+	if mt.ETag != "" {
+		req.Header.Set("If-None-Match", mt.ETag)
+	}
+	if mt.LastModified != "" {
+		req.Header.Set("If-Modified-Since", mt.LastModified)
+	}
+
+	resp, err := m.cli.Do(req)
+	if err != nil {
+		return nil, meta{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, mt, nil
+	default:
+		return nil, meta{}, errors.New(resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, meta{}, err
+	}
+	if len(data) == 0 {
+		return nil, meta{}, errors.New("empty file")
+	}
+
+	return data, meta{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+func loadMeta(sub *subscription) meta {
+	var mt meta
+	data, err := os.ReadFile(sub.metaFile())
+	if err != nil {
+		return mt
+	}
+	_ = json.Unmarshal(data, &mt)
+	return mt
+}
+
+func saveMeta(sub *subscription, mt meta) {
+	data, _ := json.Marshal(mt)
+	if err := writeFile(sub.metaFile(), data); err != nil {
+		logrus.WithError(err).WithField("file", sub.metaFile()).Warn("save subscription meta")
+	}
+}
+
+// writeFile replaces the file atomically, readers never see a partial one
+func writeFile(file string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
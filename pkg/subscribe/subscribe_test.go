@@ -0,0 +1,171 @@
+package subscribe
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestManager_Refresh(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		content  = "google.com\n"
+		etag     = `"v1"`
+		requests int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(content))
+	}))
+	defer srv.Close()
+
+	m := New(t.TempDir())
+	file, err := m.Add(srv.URL+"/gfwlist.txt", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFile := func(want string) {
+		t.Helper()
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Fatalf("file %q,expect %q", data, want)
+		}
+	}
+	assertFile("google.com\n")
+
+	// not modified
+	updated, err := m.Refresh(context.Background(), func() error {
+		t.Fatal("apply called when not modified")
+		return nil
+	})
+	if err != nil || updated {
+		t.Fatalf("updated:%v err:%v", updated, err)
+	}
+
+	mu.Lock()
+	content, etag = "google.com\ntwitter.com\n", `"v2"`
+	mu.Unlock()
+
+	// restored when apply fails
+	if _, err = m.Refresh(context.Background(), func() error {
+		assertFile("google.com\ntwitter.com\n")
+		return errors.New("parse failed")
+	}); err == nil {
+		t.Fatal("expect error")
+	}
+	assertFile("google.com\n")
+
+	updated, err = m.Refresh(context.Background(), func() error { return nil })
+	if err != nil || !updated {
+		t.Fatalf("updated:%v err:%v", updated, err)
+	}
+	assertFile("google.com\ntwitter.com\n")
+
+	// cached file is used without downloading
+	mu.Lock()
+	n := requests
+	mu.Unlock()
+	if _, err = New(m.dir).Add(srv.URL+"/gfwlist.txt", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != n {
+		t.Errorf("downloaded again")
+	}
+}
+
+func TestManager_RefreshFailed(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		content = map[string]string{"/chn.txt": "baidu.com\n", "/gfw.txt": "google.com\n"}
+		broken  bool
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if broken && r.URL.Path == "/gfw.txt" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte(content[r.URL.Path]))
+	}))
+	defer srv.Close()
+
+	m := New(t.TempDir())
+	chn, err := m.Add(srv.URL+"/chn.txt", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gfw, err := m.Add(srv.URL+"/gfw.txt", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	content["/chn.txt"], content["/gfw.txt"], broken = "qq.com\n", "twitter.com\n", true
+	mu.Unlock()
+
+	// the failed one keeps its file, the other one is still updated
+	var applied int
+	updated, err := m.Refresh(context.Background(), func() error {
+		applied++
+		return nil
+	})
+	if err != nil || !updated || applied != 1 {
+		t.Fatalf("updated:%v err:%v applied:%d", updated, err, applied)
+	}
+	for file, want := range map[string]string{chn: "qq.com\n", gfw: "google.com\n"} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("file %q,expect %q", data, want)
+		}
+	}
+}
+
+func TestManager_subscriptions(t *testing.T) {
+	m := New(t.TempDir())
+	now := time.Now()
+	m.subs = map[string]*subscription{
+		"due":     {url: "due", interval: time.Hour, next: now.Add(-time.Second)},
+		"waiting": {url: "waiting", interval: time.Minute, next: now.Add(time.Minute)},
+		"never":   {url: "never", interval: -1, next: now.Add(-time.Second)},
+	}
+
+	subs := m.subscriptions(true)
+	if len(subs) != 1 || subs[0].url != "due" {
+		t.Fatalf("due subscriptions %v", subs)
+	}
+	if next := m.subs["due"].next; next.Before(now.Add(time.Hour)) {
+		t.Errorf("next refresh %v,expect after an hour", next)
+	}
+	if subs = m.subscriptions(true); len(subs) != 0 {
+		t.Errorf("due subscriptions %v,expect none", subs)
+	}
+
+	// interval changed by adding again
+	if _, err := m.Add("waiting", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if next := m.subs["waiting"].next; next.Before(now.Add(time.Hour)) {
+		t.Errorf("next refresh %v,expect after an hour", next)
+	}
+}
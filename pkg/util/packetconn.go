@@ -0,0 +1,22 @@
+package util
+
+import "net"
+
+// PacketConn adapts a connected datagram net.Conn (such as the UDP ASSOCIATE conn of a socks5 client)
+// to net.PacketConn, so QUIC can run on it. The destination address of WriteTo is ignored.
+type PacketConn struct {
+	net.Conn
+}
+
+func NewPacketConn(c net.Conn) *PacketConn {
+	return &PacketConn{Conn: c}
+}
+
+func (c *PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := c.Conn.Read(p)
+	return n, c.Conn.RemoteAddr(), err
+}
+
+func (c *PacketConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,235 @@
+package chinadns
+
+import (
+	"fmt"
+	"github.com/0990/chinadns/pkg/matcher"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+// built-in upstream groups
+const (
+	GroupChina  = "china"  // dns-china
+	GroupAbroad = "abroad" // dns-abroad, queried by proxy if configured
+	GroupAuto   = "auto"   // query both, and use the abroad reply when the china one is not a China ip
+)
+
+// policy routes queries to an upstream group
+type policy struct {
+	name    string
+	domain  matcher.Matcher // nil matches all domains
+	qtypes  []uint16        // empty matches all types
+	clients []*net.IPNet    // empty matches all clients
+	group   string
+	builtin bool // one of the default policies, PTR queries matching it are routed by the ip
+}
+
+func (p *policy) String() string {
+	return p.name + "->" + p.group
+}
+
+// match reports whether the query matches the policy, and the domain rule matched
+func (p *policy) match(domain string, qtype uint16, client net.IP) (matcher.Rule, bool) {
+	if len(p.qtypes) > 0 && !containsQType(p.qtypes, qtype) {
+		return matcher.Rule{}, false
+	}
+	if len(p.clients) > 0 && !containsIP(p.clients, client) {
+		return matcher.Rule{}, false
+	}
+	if p.domain == nil {
+		return matcher.Rule{}, true
+	}
+	return matcher.Explain(p.domain, domain)
+}
+
+// clientScoped reports whether queries matching the policy may be routed differently for other clients
+func (p *policy) clientScoped() bool {
+	return len(p.clients) > 0
+}
+
+func containsQType(qtypes []uint16, qtype uint16) bool {
+	for _, v := range qtypes {
+		if v == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, v := range networks {
+		if v.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultPolicies routes by chn_domain, gfw_domain and then chn_ip, which are appended to the configured policies.
+func defaultPolicies(r *ruleSet) []*policy {
+	return []*policy{
+		{name: "chn_domain", domain: r.chnDomainMatcher, group: GroupChina, builtin: true},
+		{name: "gfw_domain", domain: r.gfwDomainMatcher, group: GroupAbroad, builtin: true},
+		{name: "chn_ip", group: GroupAuto, builtin: true},
+	}
+}
+
+// policyRoute is the policy matched by a query
+type policyRoute struct {
+	rules  *ruleSet
+	client *clientGroup // nil if the client is not in any group
+	policy *policy
+	rule   matcher.Rule // the domain rule matched, zero if the policy has no domain condition
+}
+
+// adBlock reports whether the query is also sent to the adblock dns
+func (r policyRoute) adBlock() bool {
+	if r.client != nil && r.client.adBlock != nil {
+		return *r.client.adBlock
+	}
+	return true
+}
+
+// route returns the first policy matched by the query, policies of the client group are checked first.
+// client is nil for queries not from clients.
+func (r *ruleSet) route(domain string, qtype uint16, client net.IP) policyRoute {
+	route := policyRoute{rules: r, client: r.clientGroup(client)}
+	if route.client != nil {
+		for _, p := range route.client.policies {
+			if rule, ok := p.match(domain, qtype, client); ok {
+				route.policy, route.rule = p, rule
+				return route
+			}
+		}
+	}
+	for _, p := range r.policies {
+		if rule, ok := p.match(domain, qtype, client); ok {
+			route.policy, route.rule = p, rule
+			return route
+		}
+	}
+	// never reached as the last default policy matches all
+	route.policy = r.policies[len(r.policies)-1]
+	return route
+}
+
+func (s *Server) route(domain string, qtype uint16, client net.IP) policyRoute {
+	return s.rules.Load().route(domain, qtype, client)
+}
+
+// groupServers returns the servers of upstream group and how to query them
+func (s *Server) groupServers(rules *ruleSet, group string) ([]*Resolver, LookupFunc) {
+	switch group {
+	case GroupChina:
+		return s.DNSChinaServers, s.lookup
+	case GroupAbroad:
+		return s.DNSAbroadServers, s.lookupProxyPriority
+	default:
+		return rules.groups[group], s.lookup
+	}
+}
+
+func WithUpstreamGroups(groups map[string][]string) ServerOption {
+	return func(o *serverOptions) error {
+		for name, schemas := range groups {
+			switch name {
+			case GroupChina, GroupAbroad, GroupAuto:
+				return fmt.Errorf("upstream group %s is reserved", name)
+			}
+			if len(schemas) == 0 {
+				return fmt.Errorf("empty upstream group %s", name)
+			}
+
+			var servers resolverList
+			for _, schema := range schemas {
+				r, err := ParseResolver(schema, false)
+				if err != nil {
+					return err
+				}
+				servers = uniqueAppendResolver(servers, r)
+			}
+			if o.rules.groups == nil {
+				o.rules.groups = make(map[string]resolverList)
+			}
+			o.rules.groups[name] = servers
+		}
+		return nil
+	}
+}
+
+// WithPolicies sets the policies checked in order before the default ones
+func WithPolicies(policies []PolicyConfig) ServerOption {
+	return func(o *serverOptions) error {
+		for i, v := range policies {
+			p, err := newPolicy(o, fmt.Sprintf("policies[%d]", i), v)
+			if err != nil {
+				return fmt.Errorf("policies[%d]:%w", i, err)
+			}
+			o.rules.policies = append(o.rules.policies, p)
+		}
+		return nil
+	}
+}
+
+func newPolicy(o *serverOptions, name string, c PolicyConfig) (*policy, error) {
+	if c.Upstream == "" {
+		return nil, fmt.Errorf("no upstream")
+	}
+	p := &policy{name: name, group: c.Upstream}
+
+	if len(c.Domain) > 0 {
+		m, err := newDomainMatcher(o, c.Domain)
+		if err != nil {
+			return nil, err
+		}
+		p.domain = m
+	}
+
+	for _, v := range c.QType {
+		qtype, ok := dns.StringToType[strings.ToUpper(v)]
+		if !ok {
+			return nil, fmt.Errorf("invalid qtype %s", v)
+		}
+		p.qtypes = append(p.qtypes, qtype)
+	}
+
+	for _, v := range c.Client {
+		network, err := parseNetwork(v)
+		if err != nil {
+			return nil, err
+		}
+		p.clients = append(p.clients, network)
+	}
+	return p, nil
+}
+
+// parseNetwork parses CIDR or a single ip
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		return network, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %s", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+}
+
+// clientIP returns the ip of client, nil if unknown
+func clientIP(w dns.ResponseWriter) net.IP {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package chinadns
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func TestRuleSet_route(t *testing.T) {
+	dir := t.TempDir()
+	opts := testRuleOptions(t, dir,
+		WithUpstreamGroups(map[string][]string{
+			"corp": {"10.0.0.53"},
+			"isp2": {"udp@202.96.128.86:53"},
+		}),
+		WithPolicies([]PolicyConfig{
+			{Domain: []string{writeTestFile(t, dir, "corp.txt", "corp.example.com\n")}, Upstream: "corp"},
+			{QType: []string{"aaaa"}, Client: []string{"192.168.2.0/24", "10.1.1.1"}, Upstream: "isp2"},
+			{Client: []string{"192.168.3.0/24"}, Upstream: GroupAbroad},
+		}),
+	)
+	rules, err := buildRules(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tbls := []struct {
+		domain string
+		qtype  uint16
+		client string
+		policy string
+	}{
+		{"git.corp.example.com", dns.TypeA, "", "policies[0]->corp"},
+		{"www.baidu.com", dns.TypeAAAA, "192.168.2.10", "policies[1]->isp2"},
+		{"www.baidu.com", dns.TypeAAAA, "10.1.1.1", "policies[1]->isp2"},
+		{"www.baidu.com", dns.TypeA, "192.168.2.10", "chn_domain->china"},
+		{"www.baidu.com", dns.TypeA, "192.168.3.10", "policies[2]->abroad"},
+		{"www.baidu.com", dns.TypeAAAA, "", "chn_domain->china"},
+		{"www.google.com", dns.TypeA, "", "gfw_domain->abroad"},
+		{"www.qq.com", dns.TypeA, "", "chn_ip->auto"},
+	}
+	for _, v := range tbls {
+		route := rules.route(v.domain, v.qtype, net.ParseIP(v.client))
+		if p := route.policy.String(); p != v.policy {
+			t.Errorf("%s %d %s policy:%s expect:%s", v.domain, v.qtype, v.client, p, v.policy)
+		}
+	}
+
+	if !rules.route("www.baidu.com", dns.TypeA, net.ParseIP("192.168.3.1")).policy.clientScoped() {
+		t.Errorf("policy with client should be scoped")
+	}
+
+	// unknown upstream group
+	opts = append(opts, WithPolicies([]PolicyConfig{{Upstream: "isp3"}}))
+	if _, err := buildRules(opts...); err == nil {
+		t.Errorf("expect unknown upstream group error")
+	}
+}
+
+func TestRuleSet_clientGroup(t *testing.T) {
+	dir := t.TempDir()
+	adBlock := false
+	rules, err := buildRules(testRuleOptions(t, dir,
+		WithClients(map[string]ClientConfig{
+			"lan": {IP: []string{"192.168.1.0/24"}},
+			"kids": {
+				IP:        []string{"192.168.1.100", "192.168.1.101"},
+				Blocklist: []string{writeTestFile(t, dir, "block.txt", "keyword:game\n")},
+			},
+			"nas": {
+				IP:       []string{"192.168.1.0/28"},
+				AdBlock:  &adBlock,
+				Policies: []PolicyConfig{{Upstream: GroupAbroad}},
+			},
+		}),
+	)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tbls := []struct {
+		client  string
+		group   string
+		policy  string
+		adBlock bool
+		blocked bool
+	}{
+		{"", "", "chn_domain->china", true, false},
+		{"10.0.0.1", "", "chn_domain->china", true, false},
+		{"192.168.1.200", "lan", "chn_domain->china", true, false},
+		{"192.168.1.100", "kids", "chn_domain->china", true, true},
+		{"192.168.1.2", "nas", "clients[nas].policies[0]->abroad", false, false},
+	}
+	for _, v := range tbls {
+		route := rules.route("game.baidu.com", dns.TypeA, net.ParseIP(v.client))
+		var group string
+		if route.client != nil {
+			group = route.client.name
+		}
+		if group != v.group {
+			t.Errorf("%s group:%s expect:%s", v.client, group, v.group)
+		}
+		if p := route.policy.String(); p != v.policy {
+			t.Errorf("%s policy:%s expect:%s", v.client, p, v.policy)
+		}
+		if route.adBlock() != v.adBlock {
+			t.Errorf("%s adblock:%v expect:%v", v.client, route.adBlock(), v.adBlock)
+		}
+		if _, blocked := route.client.blocked("game.baidu.com"); blocked != v.blocked {
+			t.Errorf("%s blocked:%v expect:%v", v.client, blocked, v.blocked)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package chinadns
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// routes of PTR queries besides domain2ip, domain2dns and the china/abroad group
+const (
+	RouteLan      = "lan"      // private address, resolved by dns-lan
+	RouteNXDomain = "nxdomain" // private address, answered NXDOMAIN as no dns-lan
+)
+
+// privateNetworks are the networks whose reverse zones are served locally by RFC 6303 and RFC 7793
+var privateNetworks = mustParseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.0.2.0/24", "192.168.0.0/16", "198.51.100.0/24", "203.0.113.0/24", "255.255.255.255/32",
+	"::/128", "::1/128", "fe80::/10", "fc00::/7", "2001:db8::/32",
+)
+
+func mustParseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, v := range cidrs {
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// WithDNSLan sets the dns resolving PTR queries of private addresses, they are answered NXDOMAIN if not set.
+func WithDNSLan(dnsLan []string) ServerOption {
+	return func(o *serverOptions) error {
+		for _, schema := range dnsLan {
+			r, err := ParseResolver(schema, false)
+			if err != nil {
+				return err
+			}
+			o.rules.lanServers = uniqueAppendResolver(o.rules.lanServers, r)
+		}
+		return nil
+	}
+}
+
+// ptrIP returns the ip of reverse domain like 4.3.2.1.in-addr.arpa, nil if it's not a full address
+func ptrIP(domain string) net.IP {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if v, ok := strings.CutSuffix(domain, ".in-addr.arpa"); ok {
+		labels := strings.Split(v, ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, label := range labels {
+			n, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[net.IPv4len-1-i] = byte(n)
+		}
+		return ip
+	}
+
+	if v, ok := strings.CutSuffix(domain, ".ip6.arpa"); ok {
+		labels := strings.Split(v, ".")
+		if len(labels) != net.IPv6len*2 {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, label := range labels {
+			n, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return nil
+			}
+			// labels are nibbles from the lowest one
+			j := len(labels) - 1 - i
+			ip[j/2] |= byte(n) << (4 * (1 - j%2))
+		}
+		return ip
+	}
+	return nil
+}
+
+// ip2Domain returns the reverse map of domain2ip, key is the ip string
+func ip2Domain(domain2IP map[string]string) map[string][]string {
+	ret := make(map[string][]string)
+	for domain, ips := range domain2IP {
+		allIPs := strings.Split(ips, ";")
+		if isAnswerNil(allIPs) {
+			continue
+		}
+		for _, v := range allIPs {
+			ip := net.ParseIP(v)
+			if ip == nil || ip.IsUnspecified() {
+				continue
+			}
+			ret[ip.String()] = append(ret[ip.String()], domain)
+		}
+	}
+	for _, domains := range ret {
+		sort.Strings(domains)
+	}
+	return ret
+}
+
+// ptrRoute returns how PTR query of ip is routed when it's not answered by domain2ip
+func (r *ruleSet) ptrRoute(ip net.IP) string {
+	if containsIP(privateNetworks, ip) {
+		if len(r.lanServers) > 0 {
+			return RouteLan
+		}
+		return RouteNXDomain
+	}
+
+	contain, err := r.chinaCIDR.Contains(ip)
+	if err != nil {
+		logrus.WithError(err).WithField("ip", ip.String()).Error("ChinaCIDR.Contains")
+	}
+	if contain {
+		return GroupChina
+	}
+	return GroupAbroad
+}
+
+// lookUpPTRInCustom answers PTR query by domain2ip
+func (s *Server) lookUpPTRInCustom(domain string, req *dns.Msg) (*dns.Msg, bool) {
+	ip := ptrIP(domain)
+	if ip == nil {
+		return nil, false
+	}
+	domains, ok := s.rules.Load().ip2Domain[ip.String()]
+	if !ok {
+		return nil, false
+	}
+
+	var rrs []dns.RR
+	for _, v := range domains {
+		s := fmt.Sprintf("%s. IN 3600 PTR %s.", domain, v)
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			logrus.WithField("rr", s).WithError(err).Error("dns.NewRR")
+			return nil, false
+		}
+		rrs = append(rrs, rr)
+	}
+
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.Answer = rrs
+	return reply, true
+}
+
+// lookupPTR resolves PTR query of ip by dns-lan for private addresses, otherwise by china dns for China ip and abroad dns for others.
+func (s *Server) lookupPTR(ip net.IP, req *dns.Msg, rules *ruleSet, logger *logrus.Entry) (*LookupResult, error) {
+	route := rules.ptrRoute(ip)
+	logger.WithFields(logrus.Fields{
+		"ip":    ip.String(),
+		"route": route,
+	}).Debug("route PTR")
+
+	switch route {
+	case RouteLan:
+		return lookupInServers(req, rules.lanServers, time.Second*2, s.lookup)
+	case RouteNXDomain:
+		reply := new(dns.Msg)
+		reply.SetRcode(req, dns.RcodeNameError)
+		return &LookupResult{reply: reply}, nil
+	default:
+		servers, lookup := s.groupServers(rules, route)
+		return lookupInServers(req, servers, time.Second*2, lookup)
+	}
+}
@@ -0,0 +1,138 @@
+package chinadns
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func Test_ptrIP(t *testing.T) {
+	tbls := []struct {
+		domain string
+		ip     string
+	}{
+		{"4.3.2.1.in-addr.arpa.", "1.2.3.4"},
+		{"10.1.168.192.IN-ADDR.ARPA", "192.168.1.10"},
+		{"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.", "4321:0:1:2:3:4:567:89ab"},
+		{"3.2.1.in-addr.arpa.", ""},
+		{"256.3.2.1.in-addr.arpa.", ""},
+		{"a.3.2.1.in-addr.arpa.", ""},
+		{"0.1.ip6.arpa.", ""},
+		{"www.qq.com.", ""},
+	}
+	for _, v := range tbls {
+		var ip string
+		if ret := ptrIP(v.domain); ret != nil {
+			ip = ret.String()
+		}
+		if ip != v.ip {
+			t.Errorf("%s ip:%s expect:%s", v.domain, ip, v.ip)
+		}
+	}
+}
+
+func TestRuleSet_ptrRoute(t *testing.T) {
+	dir := t.TempDir()
+	opts := testRuleOptions(t, dir,
+		WithDomain2IP(map[string]string{"router.lan": "192.168.1.1;::", "nas.lan": "192.168.1.2"}),
+	)
+
+	tbls := []struct {
+		domain string
+		route  string
+	}{
+		{"1.1.168.192.in-addr.arpa.", RouteDomain2IP},
+		{"3.1.168.192.in-addr.arpa.", RouteNXDomain},
+		{"1.0.0.127.in-addr.arpa.", RouteNXDomain},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.e.f.ip6.arpa.", RouteNXDomain},
+		{"1.1.0.1.in-addr.arpa.", GroupChina},
+		{"8.8.8.8.in-addr.arpa.", GroupAbroad},
+	}
+	for _, v := range tbls {
+		route, err := ExplainDomain(v.domain, dns.TypePTR, nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if route.Route != v.route {
+			t.Errorf("%s route:%s expect:%s", v.domain, route.Route, v.route)
+		}
+	}
+
+	route, err := ExplainDomain("3.1.168.192.in-addr.arpa.", dns.TypePTR, nil, append(opts, WithDNSLan([]string{"192.168.1.1"}))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.Route != RouteLan {
+		t.Errorf("route:%s expect:%s", route.Route, RouteLan)
+	}
+
+	rules, err := buildRules(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{}
+	s.rules.Store(rules)
+	req := new(dns.Msg)
+	req.SetQuestion("1.1.168.192.in-addr.arpa.", dns.TypePTR)
+	reply, ok := s.lookUpInCustom(reqDomain(req), req)
+	if !ok || len(reply.Answer) != 1 || reply.Answer[0].(*dns.PTR).Ptr != "router.lan." {
+		t.Errorf("reply:%v expect router.lan", reply)
+	}
+	if ip := net.ParseIP("192.168.1.2"); len(rules.ip2Domain[ip.String()]) != 1 {
+		t.Errorf("ip2domain:%v", rules.ip2Domain)
+	}
+}
+
+func TestRuleSet_ptrRoutePolicy(t *testing.T) {
+	dir := t.TempDir()
+	opts := testRuleOptions(t, dir,
+		WithUpstreamGroups(map[string][]string{"corp": {"10.0.0.53"}}),
+		WithPolicies([]PolicyConfig{{QType: []string{"PTR"}, Client: []string{"192.168.2.0/24"}, Upstream: "corp"}}),
+		WithClients(map[string]ClientConfig{
+			"nas": {IP: []string{"192.168.1.10"}, Policies: []PolicyConfig{{Upstream: GroupAbroad}}},
+		}),
+	)
+
+	tbls := []struct {
+		domain string
+		client string
+		route  string
+	}{
+		// chnroute 1.0.1.0/24 is routed by ip without a configured policy
+		{"1.1.0.1.in-addr.arpa.", "", GroupChina},
+		{"1.1.0.1.in-addr.arpa.", "192.168.2.10", "corp"},
+		{"3.1.168.192.in-addr.arpa.", "192.168.2.10", "corp"},
+		{"1.1.0.1.in-addr.arpa.", "192.168.1.10", GroupAbroad},
+	}
+	for _, v := range tbls {
+		route, err := ExplainDomain(v.domain, dns.TypePTR, net.ParseIP(v.client), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if route.Route != v.route {
+			t.Errorf("%s from %s route:%s expect:%s", v.domain, v.client, route.Route, v.route)
+		}
+	}
+}
+
+func TestServer_ServePTRPolicy(t *testing.T) {
+	s := newTestServer(t, newFakeUpstream("1.2.3.4"),
+		WithUpstreamGroups(map[string][]string{"corp": {"udp@10.0.0.53:53"}}),
+		WithPolicies([]PolicyConfig{{QType: []string{"PTR"}, Upstream: "corp"}}),
+	)
+	var servers []string
+	s.lookup = func(ctx context.Context, req *dns.Msg, server *Resolver) (*dns.Msg, string, error) {
+		servers = append(servers, server.String())
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		return reply, "", nil
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("1.1.0.1.in-addr.arpa.", dns.TypePTR)
+	s.Serve(&recordWriter{}, req)
+	if len(servers) != 1 || servers[0] != "udp@10.0.0.53:53" {
+		t.Errorf("queried %v,expect udp@10.0.0.53:53", servers)
+	}
+}
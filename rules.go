@@ -0,0 +1,204 @@
+package chinadns
+
+import (
+	"errors"
+	"fmt"
+	"github.com/0990/chinadns/pkg/matcher"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/yl2chen/cidranger"
+	"net"
+	"strings"
+	"sync"
+)
+
+// routes besides the upstream groups
+const (
+	RouteDomain2IP  = "domain2ip"  // answered by domain2ip
+	RouteDomain2DNS = "domain2dns" // resolved by the upstreams of domain suffix in domain2dns
+	RouteBlocked    = "blocked"    // answered NXDOMAIN by blocklist of client group
+)
+
+// DomainRoute tells how a query is routed by rules and which rule decides it
+type DomainRoute struct {
+	Domain string        `json:"domain"`
+	Route  string        `json:"route"`            // domain2ip, domain2dns, blocked, lan, nxdomain or the upstream group
+	Client string        `json:"client,omitempty"` // the client group
+	IP     string        `json:"ip,omitempty"`     // the ip of domain2ip, or the domains of ip for PTR
+	Zone   string        `json:"zone,omitempty"`   // the domain suffix of domain2dns
+	Policy string        `json:"policy,omitempty"` // the matched policy
+	Rule   *matcher.Rule `json:"rule,omitempty"`   // the matched rule of blocklist or domain list in policy
+}
+
+// ruleSet is the domain and ip rules to route queries, it's never modified after used by server except the upstreams cache,
+// and it's replaced as a whole when reloaded.
+type ruleSet struct {
+	chnDomainMatcher matcher.Matcher
+	gfwDomainMatcher matcher.Matcher
+
+	chinaCIDR    cidranger.Ranger
+	chinaCIDRLen int
+
+	domain2IP  map[string]string
+	hosts      map[string][]string     // ips of names in hosts files, merged into domain2IP
+	ip2Domain  map[string][]string     // reverse of domain2IP for PTR queries
+	domain2DNS map[string]resolverList // upstreams of domain suffixes
+	lanServers resolverList            // resolving PTR queries of private addresses
+
+	groups   map[string]resolverList // upstream groups besides the built-in ones
+	policies []*policy               // the configured policies followed by the default ones
+	clients  []*clientGroup
+
+	upstreams sync.Map // resolvers parsed from upstreams of domain rules, key is the upstream
+}
+
+// build checks the rules and appends the default policies, it's called after all options applied.
+func (r *ruleSet) build() error {
+	if r.chnDomainMatcher == nil {
+		return errors.New("no china domain list")
+	}
+	if r.gfwDomainMatcher == nil {
+		return errors.New("no gfw domain list")
+	}
+	if r.chinaCIDR == nil {
+		return errors.New("no China route list")
+	}
+	policies := append([]*policy(nil), r.policies...)
+	for _, g := range r.clients {
+		policies = append(policies, g.policies...)
+	}
+	for _, p := range policies {
+		switch p.group {
+		case GroupChina, GroupAbroad, GroupAuto:
+		default:
+			if _, ok := r.groups[p.group]; !ok {
+				return fmt.Errorf("%s:unknown upstream group %s", p.name, p.group)
+			}
+		}
+	}
+	r.policies = append(r.policies, defaultPolicies(r)...)
+	mergeHosts(r.domain2IP, r.hosts)
+	r.ip2Domain = ip2Domain(r.domain2IP)
+	return nil
+}
+
+// domainServers returns the upstream in domain rule like server=/domain/114.114.114.114 when DomainUpstream is enabled,
+// otherwise servers is returned.
+func (s *Server) domainServers(rules *ruleSet, m matcher.Matcher, domain string, servers []*Resolver) []*Resolver {
+	if !s.DomainUpstream {
+		return servers
+	}
+	um, ok := m.(matcher.UpstreamMatcher)
+	if !ok {
+		return servers
+	}
+	upstream, ok := um.Upstream(domain)
+	if !ok {
+		return servers
+	}
+
+	if v, ok := rules.upstreams.Load(upstream); ok {
+		return []*Resolver{v.(*Resolver)}
+	}
+	r, err := ParseResolver(upstream, false)
+	if err != nil {
+		logrus.WithError(err).WithField("upstream", upstream).Warn("invalid upstream in domain rule")
+		return servers
+	}
+	rules.upstreams.Store(upstream, r)
+	return []*Resolver{r}
+}
+
+func (r *ruleSet) explain(domain string, qtype uint16, client net.IP) DomainRoute {
+	domain = strings.TrimSuffix(domain, ".")
+	route := r.route(domain, qtype, client)
+	ret := DomainRoute{Domain: domain}
+	if route.client != nil {
+		ret.Client = route.client.name
+	}
+
+	if rule, ok := route.client.blocked(domain); ok {
+		ret.Route, ret.Rule = RouteBlocked, &rule
+		return ret
+	}
+	if ip, ok := r.domain2IP[strings.ToLower(domain)]; ok {
+		ret.Route, ret.IP = RouteDomain2IP, ip
+		return ret
+	}
+	ip := ptrIP(domain)
+	if qtype == dns.TypePTR && ip != nil {
+		if domains, ok := r.ip2Domain[ip.String()]; ok {
+			ret.Route, ret.IP = RouteDomain2IP, strings.Join(domains, ";")
+			return ret
+		}
+	}
+	if zone, _, ok := r.stubZone(domain); ok {
+		ret.Route, ret.Zone = RouteDomain2DNS, zone
+		return ret
+	}
+	if qtype == dns.TypePTR && ip != nil && route.policy.builtin {
+		ret.Route = r.ptrRoute(ip)
+		return ret
+	}
+
+	ret.Route, ret.Policy = route.policy.group, route.policy.name
+	if route.policy.domain != nil {
+		ret.Rule = &route.rule
+	}
+	return ret
+}
+
+// ExplainDomain returns how a query is routed by the running rules, client can be nil.
+func (s *Server) ExplainDomain(domain string, qtype uint16, client net.IP) DomainRoute {
+	return s.rules.Load().explain(domain, qtype, client)
+}
+
+// ExplainDomain returns how a query is routed by rules built from options, like ReloadRules.
+func ExplainDomain(domain string, qtype uint16, client net.IP, opts ...ServerOption) (DomainRoute, error) {
+	rules, err := buildRules(opts...)
+	if err != nil {
+		return DomainRoute{}, err
+	}
+	return rules.explain(domain, qtype, client), nil
+}
+
+func buildRules(opts ...ServerOption) (*ruleSet, error) {
+	o := newServerOptions()
+	for _, f := range opts {
+		if err := f(o); err != nil {
+			return nil, err
+		}
+	}
+	if err := o.rules.build(); err != nil {
+		return nil, err
+	}
+	return o.rules, nil
+}
+
+// ReloadRules rebuilds rules by WithChnDomain,WithGfwDomain,WithCHNFile,WithDomain2IP,WithHosts and WithDomain2DNS etc., and replaces the running ones.
+// Other options are ignored. The running rules are kept when any of them fails.
+// Caches are flushed after replaced, as the cached replies may be routed differently by the new rules.
+func (s *Server) ReloadRules(opts ...ServerOption) error {
+	rules, err := buildRules(opts...)
+	if err != nil {
+		return err
+	}
+
+	old := s.rules.Swap(rules)
+	flushed := s.flushCaches()
+
+	logrus.WithFields(logrus.Fields{
+		"chn_domain": countDiff(old.chnDomainMatcher.Len(), rules.chnDomainMatcher.Len()),
+		"gfw_domain": countDiff(old.gfwDomainMatcher.Len(), rules.gfwDomainMatcher.Len()),
+		"chn_ip":     countDiff(old.chinaCIDRLen, rules.chinaCIDRLen),
+		"domain2ip":  countDiff(len(old.domain2IP), len(rules.domain2IP)),
+		"hosts":      countDiff(len(old.hosts), len(rules.hosts)),
+		"domain2dns": countDiff(len(old.domain2DNS), len(rules.domain2DNS)),
+		"flushed":    flushed,
+	}).Info("rules reloaded")
+	return nil
+}
+
+func countDiff(old, new int) string {
+	return fmt.Sprintf("%d->%d(%+d)", old, new, new-old)
+}
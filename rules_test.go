@@ -0,0 +1,149 @@
+package chinadns
+
+import (
+	"github.com/0990/chinadns/pkg/cache"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_ReloadRules(t *testing.T) {
+	dir := t.TempDir()
+
+	chnDomain := writeTestFile(t, dir, "chn.txt", "baidu.com\n")
+	gfwDomain := writeTestFile(t, dir, "gfw.txt", "google.com\n")
+	chnIP := writeTestFile(t, dir, "chnroute.txt", "1.0.1.0/24\n")
+	opts := func(domain2ip map[string]string) []ServerOption {
+		return []ServerOption{
+			WithChnDomain([]string{chnDomain}),
+			WithGfwDomain([]string{gfwDomain}),
+			WithCHNFile([]string{chnIP}),
+			WithDomain2IP(domain2ip),
+		}
+	}
+
+	o := newServerOptions()
+	for _, f := range opts(nil) {
+		if err := f(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Server{serverOptions: o, cache: cache.NewDNSCache(time.Hour)}
+	s.rules.Store(o.rules)
+
+	// replies routed by the old rules are flushed
+	reply := new(dns.Msg)
+	reply.SetQuestion("www.qq.com.", dns.TypeA)
+	a, _ := dns.NewRR("www.qq.com. 600 IN A 1.2.3.4")
+	reply.Answer = []dns.RR{a}
+	s.setCached(s.cache, reply.Question[0], &LookupResult{reply: reply})
+	s.setCached(s.cacheOf(&clientGroup{name: "kids"}), reply.Question[0], &LookupResult{reply: reply})
+
+	writeTestFile(t, dir, "chn.txt", "baidu.com\nqq.com\n")
+	writeTestFile(t, dir, "chnroute.txt", "1.0.1.0/24\n1.0.2.0/23\n")
+	if err := s.ReloadRules(opts(map[string]string{"a.b": "127.0.0.1"})...); err != nil {
+		t.Fatal(err)
+	}
+	rules := s.rules.Load()
+	if !rules.chnDomainMatcher.IsMatch("www.qq.com") || rules.chnDomainMatcher.Len() != 2 {
+		t.Errorf("chn domain not reloaded")
+	}
+	if ok, _ := rules.chinaCIDR.Contains(net.ParseIP("1.0.2.1")); !ok {
+		t.Errorf("chn ip not reloaded")
+	}
+	if _, ok := rules.domain2IP["a.b"]; !ok {
+		t.Errorf("domain2ip not reloaded")
+	}
+	if n := s.cache.Len(); n != 0 {
+		t.Errorf("cache not flushed,len %d", n)
+	}
+	if _, ok := s.clientCaches.Load("kids"); ok {
+		t.Errorf("cache of client group not removed")
+	}
+
+	// keep the running rules when failed
+	writeTestFile(t, dir, "chnroute.txt", "1.0.1.0/24\nbad\n")
+	if err := s.ReloadRules(opts(nil)...); err == nil {
+		t.Fatalf("expect error")
+	}
+	if s.rules.Load() != rules {
+		t.Errorf("rules replaced when reload failed")
+	}
+}
+
+func TestExplainDomain(t *testing.T) {
+	dir := t.TempDir()
+
+	chnDomain := writeTestFile(t, dir, "chn.txt", "# china\nbaidu.com\nfull:www.qq.com\n")
+	gfwDomain := writeTestFile(t, dir, "gfw.txt", "keyword:google\n")
+	opts := []ServerOption{
+		WithChnDomain([]string{chnDomain}),
+		WithGfwDomain([]string{gfwDomain}),
+		WithCHNFile([]string{writeTestFile(t, dir, "chnroute.txt", "1.0.1.0/24\n")}),
+		WithDomain2IP(map[string]string{"router.lan": "192.168.1.1"}),
+		WithDomain2DNS(map[string][]string{"lan": {"192.168.1.1"}}),
+	}
+
+	tbls := []struct {
+		domain string
+		route  string
+		rule   string
+	}{
+		{"router.lan.", RouteDomain2IP, ""},
+		{"nas.lan.", RouteDomain2DNS, ""},
+		{"map.baidu.com.", GroupChina, "domain:baidu.com(" + chnDomain + ":2)"},
+		{"www.qq.com", GroupChina, "full:www.qq.com(" + chnDomain + ":3)"},
+		{"www.google.com.hk", GroupAbroad, "keyword:google(" + gfwDomain + ":1)"},
+		{"qq.com", GroupAuto, ""},
+	}
+	for _, v := range tbls {
+		route, err := ExplainDomain(v.domain, dns.TypeA, nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rule string
+		if route.Rule != nil {
+			rule = route.Rule.String()
+		}
+		if route.Route != v.route || rule != v.rule {
+			t.Errorf("domain:%s route:%s rule:%s expect %s %s", v.domain, route.Route, rule, v.route, v.rule)
+		}
+	}
+}
+
+func TestRuleSet_stubZone(t *testing.T) {
+	o := newServerOptions()
+	err := WithDomain2DNS(map[string][]string{
+		"example.com":          {"10.0.0.53"},
+		"Corp.Example.com.":    {"10.0.1.53", "udp@10.0.1.54:53"},
+		"168.192.in-addr.arpa": {"192.168.1.1"},
+	})(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tbls := []struct {
+		domain  string
+		zone    string
+		servers int
+	}{
+		{"example.com", "example.com", 1},
+		{"www.example.com.", "example.com", 1},
+		{"git.corp.EXAMPLE.com", "corp.example.com", 2},
+		{"1.1.168.192.in-addr.arpa.", "168.192.in-addr.arpa", 1},
+		{"1.1.1.10.in-addr.arpa.", "", 0},
+		{"badexample.com", "", 0},
+		{"com", "", 0},
+	}
+	for _, v := range tbls {
+		zone, servers, _ := o.rules.stubZone(v.domain)
+		if zone != v.zone || len(servers) != v.servers {
+			t.Errorf("%s zone:%s servers:%d expect %s %d", v.domain, zone, len(servers), v.zone, v.servers)
+		}
+	}
+
+	if err := WithDomain2DNS(map[string][]string{"lan": nil})(newServerOptions()); err == nil {
+		t.Errorf("expect no upstream error")
+	}
+}
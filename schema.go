@@ -5,11 +5,12 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"strconv"
 	"strings"
 )
 
 var (
-	supportedProtocols   = []string{"udp", "tcp", "doh"}
+	supportedProtocols   = []string{"udp", "tcp", "doh", "doh3", "dot", "doq"}
 	supportedProtocolMap = make(map[string]bool)
 
 	ErrUnknowProtocol  = errors.New("unknown protocol")
@@ -28,8 +29,9 @@ func SupportedProtocols() []string {
 
 // Resolver contains info about a single upstream DNS server.
 type Resolver struct {
-	Addr      string   //address of the resolver in format ip:port
-	Protocols []string //list of protocols to use with this resolver, in order of execution
+	Addr       string   //address of the resolver in format ip:port
+	Protocols  []string //list of protocols to use with this resolver, in order of execution
+	ServerName string   //tls server name(SNI) of dot/doq resolver, host of Addr is used when empty
 }
 
 func (r *Resolver) GetAddr() string {
@@ -45,6 +47,10 @@ func (r *Resolver) String() string {
 	sb.WriteString(strings.Join(r.Protocols, "+"))
 	sb.WriteByte('@')
 	sb.WriteString(r.Addr)
+	if r.ServerName != "" {
+		sb.WriteByte('#')
+		sb.WriteString(r.ServerName)
+	}
 	return sb.String()
 }
 
@@ -62,12 +68,14 @@ func (r resolverList) String() string {
 
 // ParseResolver takes a single resolver in schema string format and outputs a resolver struct.
 // It also accept regular ip[:port] format for backwards compatibility.
-// The schema is defined as:  [protocol[+protocol]@]host[:port][/endpoint]
+// The schema is defined as:  [protocol[+protocol]@]host[:port][/endpoint][#servername]
+// #servername is only allowed for dot and doq, which overrides the tls server name.
 func ParseResolver(schema string, tcpOnly bool) (r *Resolver, err error) {
 	err = nil
 	var (
-		addr   string
-		protos []string
+		addr       string
+		protos     []string
+		serverName string
 	)
 	fields := strings.Split(schema, "@")
 	if len(fields) == 1 { // schema in ip[:port] format
@@ -87,6 +95,14 @@ func ParseResolver(schema string, tcpOnly bool) (r *Resolver, err error) {
 		}
 	}
 
+	if i := strings.LastIndex(addr, "#"); i >= 0 {
+		addr, serverName = addr[:i], addr[i+1:]
+		if serverName == "" || !isTLSProtocols(protos) {
+			err = fmt.Errorf("%w [%s]", ErrInvalidResolver, schema)
+			return
+		}
+	}
+
 	// Process host port
 	if _, _, err = net.SplitHostPort(addr); err != nil {
 		if strings.Contains(err.Error(), "missing port in address") ||
@@ -94,7 +110,7 @@ func ParseResolver(schema string, tcpOnly bool) (r *Resolver, err error) {
 			if strings.Contains(addr, "[") {
 				return
 			}
-			addr, err = net.JoinHostPort(addr, "53"), nil
+			addr, err = net.JoinHostPort(addr, defaultPort(protos)), nil
 		} else {
 			return
 		}
@@ -108,12 +124,36 @@ func ParseResolver(schema string, tcpOnly bool) (r *Resolver, err error) {
 	}
 
 	r = &Resolver{
-		Addr:      addr,
-		Protocols: protos,
+		Addr:       addr,
+		Protocols:  protos,
+		ServerName: serverName,
 	}
 	return
 }
 
+// defaultPort returns the port used when it's omitted in schema.
+func defaultPort(protos []string) string {
+	if isTLSProtocols(protos) {
+		return "853"
+	}
+	return "53"
+}
+
+// isTLSProtocols reports whether protos only contains protocols over tls with host:port address.
+func isTLSProtocols(protos []string) bool {
+	if len(protos) == 0 {
+		return false
+	}
+	for _, proto := range protos {
+		switch proto {
+		case "dot", "doq":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // checkProtocolHost checks if a valid protocol-host pair is specified.
 func checkProtocolHost(proto, addr string) error {
 	if _, ok := supportedProtocolMap[proto]; !ok {
@@ -130,7 +170,19 @@ func checkProtocolHost(proto, addr string) error {
 		if ip := net.ParseIP(host); ip == nil {
 			return errInvalid
 		}
-	case "doh":
+	case "dot", "doq":
+		// Both IP and domain name are allowed, domain name is resolved by system resolver
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		if host == "" || strings.ContainsAny(host, "/?") {
+			return errInvalid
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return errInvalid
+		}
+	case "doh", "doh3":
 		u, err := url.Parse(addr)
 		if err != nil {
 			return err
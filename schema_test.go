@@ -53,8 +53,42 @@ func Test_schemaToResolver(t *testing.T) {
 			Protocols: []string{"doh"},
 		}, false},
 		{"doh+udp@https://doh.serv/query", nil, true},
+		{"doh3@https://doh.serv/query", &Resolver{
+			Addr:      "https://doh.serv/query",
+			Protocols: []string{"doh3"},
+		}, false},
+		{"doh3+doh@https://doh.serv/query", &Resolver{
+			Addr:      "https://doh.serv/query",
+			Protocols: []string{"doh3", "doh"},
+		}, false},
 		{"https://doh.serv/query", nil, true},
 		{"udp@https://doh.serv/query", nil, true},
+		{"dot@1.1.1.1", &Resolver{
+			Addr:      "1.1.1.1:853",
+			Protocols: []string{"dot"},
+		}, false},
+		{"dot@dns.google:853", &Resolver{
+			Addr:      "dns.google:853",
+			Protocols: []string{"dot"},
+		}, false},
+		{"dot@8.8.8.8:853#dns.google", &Resolver{
+			Addr:       "8.8.8.8:853",
+			Protocols:  []string{"dot"},
+			ServerName: "dns.google",
+		}, false},
+		{"dot@8.8.8.8#", nil, true},
+		{"udp@8.8.8.8#dns.google", nil, true},
+		{"dot@https://doh.serv/query", nil, true},
+		{"doq@dns.adguard-dns.com", &Resolver{
+			Addr:      "dns.adguard-dns.com:853",
+			Protocols: []string{"doq"},
+		}, false},
+		{"doq+dot@94.140.14.14#dns.adguard-dns.com", &Resolver{
+			Addr:       "94.140.14.14:853",
+			Protocols:  []string{"doq", "dot"},
+			ServerName: "dns.adguard-dns.com",
+		}, false},
+		{"doq+udp@94.140.14.14#dns.adguard-dns.com", nil, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
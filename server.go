@@ -2,10 +2,18 @@ package chinadns
 
 import (
 	"context"
+	"errors"
 	cache2 "github.com/0990/chinadns/pkg/cache"
+	"github.com/0990/chinadns/pkg/doh"
+	"github.com/0990/chinadns/pkg/doq"
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Server struct {
@@ -13,10 +21,32 @@ type Server struct {
 	*Client
 	UDPServer *dns.Server
 	TCPServer *dns.Server
+	DoHServer *http.Server
+	DoTServer *dns.Server
+	DoQServer *doq.Server
 
 	requestID uint32
 
-	cache cache2.DNSCache
+	// queries to upstreams, which are Client.lookup and Client.lookupProxyPriority except in tests
+	lookup              LookupFunc
+	lookupProxyPriority LookupFunc
+
+	rules atomic.Pointer[ruleSet]
+
+	certs *certLoader // certificate of encrypted listeners, nil when not configured
+
+	cache        cache2.DNSCache
+	clientCaches sync.Map // caches of client groups, key is the group name
+	refreshGroup singleflight.Group
+}
+
+func newCache(o *serverOptions) cache2.DNSCache {
+	return cache2.NewDNSCache(time.Duration(o.CacheExpireSec)*time.Second,
+		cache2.WithMinTTL(time.Duration(o.CacheMinTTL)*time.Second),
+		cache2.WithServeStale(time.Duration(o.CacheStaleMaxAge)*time.Second),
+		cache2.WithMaxEntries(o.CacheMaxEntries),
+		cache2.WithMaxBytes(o.CacheMaxBytes),
+	)
 }
 
 func NewServer(cli *Client, opts ...ServerOption) (*Server, error) {
@@ -27,6 +57,9 @@ func NewServer(cli *Client, opts ...ServerOption) (*Server, error) {
 			return nil, err
 		}
 	}
+	if err := o.rules.build(); err != nil {
+		return nil, err
+	}
 
 	//ss-tproxy need 53 port udp4,otherwise not work,set udp back when fix
 	s := &Server{
@@ -34,12 +67,70 @@ func NewServer(cli *Client, opts ...ServerOption) (*Server, error) {
 		Client:        cli,
 		UDPServer:     &dns.Server{Addr: o.Listen, Net: "udp", ReusePort: true},
 		TCPServer:     &dns.Server{Addr: o.Listen, Net: "tcp", ReusePort: true},
-		cache:         cache2.NewDNSCache(o.CacheExpireSec),
+		cache:         newCache(o),
+
+		lookup:              cli.lookup,
+		lookupProxyPriority: cli.lookupProxyPriority,
 	}
 
+	s.rules.Store(o.rules)
+
 	s.UDPServer.Handler = dns.HandlerFunc(s.Serve)
 	s.TCPServer.Handler = dns.HandlerFunc(s.Serve)
 
+	if o.TLSCertFile != "" {
+		l, err := newCertLoader(o.TLSCertFile, o.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.certs = l
+	}
+	certs := s.certs
+
+	if n, err := s.LoadCache(); err != nil {
+		logrus.WithError(err).Warn("load cache file")
+	} else if n > 0 {
+		logrus.WithFields(logrus.Fields{
+			"file":  o.CacheFile,
+			"count": n,
+		}).Info("cache loaded")
+	}
+
+	if o.DoHListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle(o.DoHPath, doh.NewHandler(dns.HandlerFunc(s.Serve)))
+		s.DoHServer = &http.Server{Addr: o.DoHListen, Handler: mux}
+
+		// serve plain http when no cert, which is used behind a https reverse proxy
+		if certs != nil {
+			s.DoHServer.TLSConfig = certs.TLSConfig()
+		}
+	}
+
+	if o.DoTListen != "" || o.DoQListen != "" {
+		if certs == nil {
+			return nil, errors.New("tls cert is required by dot and doq listener")
+		}
+	}
+
+	if o.DoTListen != "" {
+		s.DoTServer = &dns.Server{
+			Addr:      o.DoTListen,
+			Net:       "tcp-tls",
+			ReusePort: true,
+			TLSConfig: certs.TLSConfig("dot"),
+			Handler:   dns.HandlerFunc(s.Serve),
+		}
+	}
+
+	if o.DoQListen != "" {
+		s.DoQServer = &doq.Server{
+			Addr:      o.DoQListen,
+			TLSConfig: certs.TLSConfig(doq.NextProtoDQ),
+			Handler:   dns.HandlerFunc(s.Serve),
+		}
+	}
+
 	return s, nil
 }
 
@@ -52,6 +143,27 @@ func (s *Server) Run() error {
 	eg.Go(func() error {
 		return runTCPServer(s.TCPServer)
 	})
+	if s.DoHServer != nil {
+		logrus.Info("Start DoH server at ", s.DoHServer.Addr, s.DoHPath)
+		eg.Go(func() error {
+			return runDoHServer(s.DoHServer)
+		})
+	}
+	if s.DoTServer != nil {
+		logrus.Info("Start DoT server at ", s.DoTServer.Addr)
+		eg.Go(func() error {
+			return runTLSServer(s.DoTServer)
+		})
+	}
+	if s.DoQServer != nil {
+		logrus.Info("Start DoQ server at ", s.DoQServer.Addr)
+		eg.Go(func() error {
+			return runDoQServer(s.DoQServer)
+		})
+	}
+	if s.CacheFile != "" && s.CacheSnapshotSec > 0 {
+		eg.Go(s.snapshotCache)
+	}
 	return eg.Wait()
 }
 
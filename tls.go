@@ -0,0 +1,120 @@
+package chinadns
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const certCheckInterval = time.Second * 10
+
+// certLoader loads the certificate of encrypted listeners, and reloads it when the files on disk change,
+// so renewed certificates (e.g. by acme.sh, certbot) take effect without restart.
+type certLoader struct {
+	certFile string
+	keyFile  string
+
+	sync.RWMutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertLoader(certFile, keyFile string) (*certLoader, error) {
+	l := &certLoader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	modTime, err := l.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err = l.load(modTime); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// TLSConfig returns a tls config whose certificate is always the latest one.
+func (l *certLoader) TLSConfig(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     nextProtos,
+		GetCertificate: l.GetCertificate,
+	}
+}
+
+func (l *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.RLock()
+	cert := l.cert
+	check := time.Since(l.checkedAt) > certCheckInterval
+	l.RUnlock()
+
+	if check {
+		l.reloadIfModified()
+		l.RLock()
+		cert = l.cert
+		l.RUnlock()
+	}
+	return cert, nil
+}
+
+func (l *certLoader) reloadIfModified() {
+	l.Lock()
+	if time.Since(l.checkedAt) <= certCheckInterval {
+		l.Unlock()
+		return
+	}
+	l.checkedAt = time.Now()
+	lastModTime := l.modTime
+	l.Unlock()
+
+	modTime, err := l.latestModTime()
+	if err != nil {
+		logrus.WithError(err).Error("stat tls cert")
+		return
+	}
+	if !modTime.After(lastModTime) {
+		return
+	}
+
+	// keep the old certificate when the new one is broken, e.g. only one of the files is written
+	if err = l.load(modTime); err != nil {
+		logrus.WithError(err).Error("reload tls cert")
+		return
+	}
+	logrus.WithField("cert", l.certFile).Info("tls cert reloaded")
+}
+
+func (l *certLoader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return fmt.Errorf("load tls cert: %w", err)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	l.cert = &cert
+	l.modTime = modTime
+	l.checkedAt = time.Now()
+	return nil
+}
+
+func (l *certLoader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{l.certFile, l.keyFile} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,132 @@
+package chinadns
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/0990/chinadns/pkg/dot"
+	"github.com/miekg/dns"
+)
+
+// selfSignedPEM returns a self-signed certificate of dns.test and 127.0.0.1 and its key in PEM
+func selfSignedPEM(t *testing.T, serial int64) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "dns.test"},
+		DNSNames:     []string{"dns.test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeCertFiles writes the pair with a later mod time, as files may be rewritten within the precision of mod time
+func writeCertFiles(t *testing.T, certFile, keyFile string, certPEM, keyPEM []byte, modTime time.Time) {
+	for file, data := range map[string][]byte{certFile: certPEM, keyFile: keyPEM} {
+		if err := os.WriteFile(file, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// exchangeDoT queries www.baidu.com over DoT, trusting only the certificate
+func exchangeDoT(t *testing.T, addr string, certPEM []byte) error {
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+	c := dot.NewClient(dot.WithTimeout(time.Second*2), dot.WithTLSConfig(&tls.Config{RootCAs: pool}))
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.baidu.com.", dns.TypeA)
+	r, _, err := c.Exchange(context.Background(), req, addr, "dns.test")
+	if err != nil {
+		return err
+	}
+	checkAnswer(t, r, "1.2.3.4", 0)
+	return nil
+}
+
+func TestServer_DoTCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := writeTestFile(t, dir, "cert.pem", "")
+	keyFile := writeTestFile(t, dir, "key.pem", "")
+	cert1, key1 := selfSignedPEM(t, 1)
+	writeCertFiles(t, certFile, keyFile, cert1, key1, time.Now().Add(-time.Minute))
+
+	s := newTestServer(t, newFakeUpstream("1.2.3.4"), WithTLSCert(certFile, keyFile), WithDoTListen("127.0.0.1:0"))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveTLS(s.DoTServer, ln)
+	defer s.DoTServer.Shutdown()
+
+	addr := ln.Addr().String()
+	if err := exchangeDoT(t, addr, cert1); err != nil {
+		t.Fatal(err)
+	}
+
+	// leaf returns the certificate served now, files are checked again as checkedAt is backdated
+	leaf := func() []byte {
+		s.certs.Lock()
+		s.certs.checkedAt = time.Time{}
+		s.certs.Unlock()
+		cert, err := s.certs.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.Certificate[0]
+	}
+	der := func(certPEM []byte) []byte {
+		block, _ := pem.Decode(certPEM)
+		return block.Bytes
+	}
+
+	// rotated
+	cert2, key2 := selfSignedPEM(t, 2)
+	writeCertFiles(t, certFile, keyFile, cert2, key2, time.Now())
+	if !bytes.Equal(leaf(), der(cert2)) {
+		t.Fatal("certificate is not reloaded")
+	}
+	if err := exchangeDoT(t, addr, cert2); err != nil {
+		t.Fatal(err)
+	}
+
+	// the old one is kept when the key is half written
+	cert3, key3 := selfSignedPEM(t, 3)
+	writeCertFiles(t, certFile, keyFile, cert3, key3[:len(key3)/2], time.Now().Add(time.Minute))
+	if !bytes.Equal(leaf(), der(cert2)) {
+		t.Fatal("certificate is replaced by a broken pair")
+	}
+	if err := exchangeDoT(t, addr, cert2); err != nil {
+		t.Fatal(err)
+	}
+}